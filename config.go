@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// config holds user defaults from ~/.config/nix-envs/config.toml:
+//
+//	nixpkgs = "nixos-24.05"   # branch or revision new envs are pinned to
+//	history_limit = 20        # flake versions kept per env
+//	history_days = 30         # days history and deleted envs are kept
+type config struct {
+	Nixpkgs      string
+	HistoryLimit int
+	HistoryDays  int
+}
+
+const (
+	defaultHistoryLimit = 20
+	defaultHistoryDays  = 30
+)
+
+func getConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "nix-envs")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "nix-envs")
+}
+
+// loadConfig reads the user config, returning defaults if it does not exist.
+func loadConfig() (*config, error) {
+	path := filepath.Join(getConfigDir(), "config.toml")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &config{HistoryLimit: defaultHistoryLimit, HistoryDays: defaultHistoryDays}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseTOML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	cfg := &config{Nixpkgs: doc.str("", "nixpkgs"), HistoryLimit: defaultHistoryLimit, HistoryDays: defaultHistoryDays}
+	if n, ok := doc[""]["history_limit"].(int64); ok && n > 0 {
+		cfg.HistoryLimit = int(n)
+	}
+	if n, ok := doc[""]["history_days"].(int64); ok && n > 0 {
+		cfg.HistoryDays = int(n)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	versionTokenPattern = regexp.MustCompile(`\d+(\.\d+){0,2}`)
+	goDirectivePattern  = regexp.MustCompile(`(?m)^go\s+(\S+)`)
+	goToolchainPattern  = regexp.MustCompile(`(?m)^toolchain\s+go(\S+)`)
+	mixElixirPattern    = regexp.MustCompile(`elixir:\s*"([^"]+)"`)
+)
+
+// detection is a template and version inferred from a project file.
+type detection struct {
+	Template string
+	Version  string
+	Source   string
+}
+
+// detector inspects the project directory and reports a detection, or nil if
+// the files it looks for are absent.
+type detector func() *detection
+
+var detectors = []detector{
+	detectNodeJS,
+	detectGo,
+	detectRust,
+	detectPython,
+	detectElixir,
+	detectLua,
+}
+
+func handleInit(args []string) {
+	_, flags := parseFlags(args)
+	yes := flags.has("--yes")
+	track := flags.has("--track")
+
+	detections := detectTemplates()
+	if len(detections) == 0 {
+		fatal("No toolchain files found. Use: nix-envs create <template> <version>")
+	}
+
+	fmt.Println("Detected toolchains:")
+	for _, d := range detections {
+		fmt.Printf("  %-8s %-10s (from %s)\n", d.Template, d.Version, d.Source)
+	}
+
+	var failed []string
+	for _, d := range detections {
+		if !yes && !confirm(fmt.Sprintf("Create %s %s?", d.Template, d.Version)) {
+			continue
+		}
+		if err := createEnv(envRequest{Template: d.Template, Version: d.Version, Track: track}); err != nil {
+			fmt.Printf("%sError: %s%s\n", ColorRed, err.Error(), ColorReset)
+			failed = append(failed, d.Template)
+		}
+	}
+	if len(failed) > 0 {
+		fatal("Failed to create: " + strings.Join(failed, ", "))
+	}
+}
+
+func detectTemplates() []detection {
+	var found []detection
+	for _, detect := range detectors {
+		if d := detect(); d != nil {
+			found = append(found, *d)
+		}
+	}
+	return found
+}
+
+// readVersionFile returns the first non-comment line of a dotfile such as
+// .nvmrc or .python-version.
+func readVersionFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return ""
+}
+
+// versionFromRange picks the first version number out of a constraint such as
+// ">=18.17 <21" or "~> 1.15", to be resolved as a partial version.
+func versionFromRange(constraint string) string {
+	return versionTokenPattern.FindString(constraint)
+}
+
+func detectNodeJS() *detection {
+	for _, file := range []string{".nvmrc", ".node-version"} {
+		v := strings.ToLower(readVersionFile(file))
+		switch {
+		case v == "":
+			continue
+		case v == "node" || v == "stable" || v == "current":
+			return &detection{"nodejs", "latest", file}
+		case strings.HasPrefix(v, "lts"):
+			return &detection{"nodejs", v, file}
+		}
+		if version := versionFromRange(v); version != "" {
+			return &detection{"nodejs", version, file}
+		}
+	}
+
+	data, err := os.ReadFile("package.json")
+	if err != nil {
+		return nil
+	}
+	var pkg struct {
+		Engines struct {
+			Node string `json:"node"`
+		} `json:"engines"`
+	}
+	if json.Unmarshal(data, &pkg) != nil {
+		return nil
+	}
+	if version := versionFromRange(pkg.Engines.Node); version != "" {
+		return &detection{"nodejs", version, "package.json engines"}
+	}
+	return nil
+}
+
+func detectGo() *detection {
+	data, err := os.ReadFile("go.mod")
+	if err != nil {
+		return nil
+	}
+	if m := goToolchainPattern.FindSubmatch(data); m != nil {
+		return &detection{"go", string(m[1]), "go.mod toolchain"}
+	}
+	if m := goDirectivePattern.FindSubmatch(data); m != nil {
+		return &detection{"go", string(m[1]), "go.mod go directive"}
+	}
+	return nil
+}
+
+func detectRust() *detection {
+	channel, source := "", ""
+	if data, err := os.ReadFile("rust-toolchain.toml"); err == nil {
+		doc, err := parseTOML(string(data))
+		if err != nil {
+			fmt.Printf("%sWarning: could not parse rust-toolchain.toml: %v%s\n", ColorYellow, err, ColorReset)
+			return nil
+		}
+		channel, source = doc.str("toolchain", "channel"), "rust-toolchain.toml"
+	} else if v := readVersionFile("rust-toolchain"); v != "" {
+		channel, source = v, "rust-toolchain"
+	}
+
+	switch {
+	case channel == "":
+		return nil
+	case channel == "stable":
+		return &detection{"rust", "latest", source}
+	case versionTokenPattern.MatchString(channel) && !strings.ContainsAny(channel, "-"):
+		return &detection{"rust", channel, source}
+	}
+	fmt.Printf("%sSkipping rust channel %q from %s: only stable releases are supported.%s\n", ColorYellow, channel, source, ColorReset)
+	return nil
+}
+
+func detectPython() *detection {
+	v := readVersionFile(".python-version")
+	if v == "" || v[0] < '0' || v[0] > '9' {
+		return nil
+	}
+	return &detection{"python", v, ".python-version"}
+}
+
+func detectElixir() *detection {
+	data, err := os.ReadFile("mix.exs")
+	if err != nil {
+		return nil
+	}
+	m := mixElixirPattern.FindSubmatch(data)
+	if m == nil {
+		return nil
+	}
+	if version := versionFromRange(string(m[1])); version != "" {
+		return &detection{"elixir", version, "mix.exs"}
+	}
+	return nil
+}
+
+func detectLua() *detection {
+	v := readVersionFile(".lua-version")
+	if v == "" {
+		return nil
+	}
+	return &detection{"lua", strings.TrimPrefix(v, "lua-"), ".lua-version"}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// diffLines computes a line-based diff of two texts using the longest common
+// subsequence. Flakes are small, so the quadratic table is fine.
+func diffLines(a, b string) []diffOp {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			ops = append(ops, diffOp{' ', x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', x[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		ops = append(ops, diffOp{'-', x[i]})
+	}
+	for ; j < len(y); j++ {
+		ops = append(ops, diffOp{'+', y[j]})
+	}
+	return ops
+}
+
+func hasChanges(ops []diffOp) bool {
+	for _, op := range ops {
+		if op.kind != ' ' {
+			return true
+		}
+	}
+	return false
+}
+
+// printDiff writes the changed lines of ops with a few lines of context,
+// eliding unchanged stretches.
+func printDiff(ops []diffOp) {
+	show := make([]bool, len(ops))
+	for i, op := range ops {
+		if op.kind == ' ' {
+			continue
+		}
+		for k := max(0, i-diffContext); k <= min(len(ops)-1, i+diffContext); k++ {
+			show[k] = true
+		}
+	}
+
+	skipped := false
+	for i, op := range ops {
+		if !show[i] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			fmt.Printf("%s@@ ... @@%s\n", ColorBlue, ColorReset)
+			skipped = false
+		}
+		switch op.kind {
+		case '-':
+			fmt.Printf("%s-%s%s\n", ColorRed, op.line, ColorReset)
+		case '+':
+			fmt.Printf("%s+%s%s\n", ColorGreen, op.line, ColorReset)
+		default:
+			fmt.Printf(" %s\n", op.line)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// doctorReport prints the outcome of each check with a fix for anything
+// wrong, counting the problems found.
+type doctorReport struct {
+	problems int
+	warnings int
+}
+
+func (r *doctorReport) ok(check, detail string) {
+	fmt.Printf("%s[ok]%s   %s: %s\n", ColorGreen, ColorReset, check, detail)
+}
+
+func (r *doctorReport) warn(check, detail, fix string) {
+	r.warnings++
+	fmt.Printf("%s[warn]%s %s: %s\n", ColorYellow, ColorReset, check, detail)
+	fmt.Printf("       fix: %s\n", fix)
+}
+
+func (r *doctorReport) fail(check, detail, fix string) {
+	r.problems++
+	fmt.Printf("%s[fail]%s %s: %s\n", ColorRed, ColorReset, check, detail)
+	fmt.Printf("       fix: %s\n", fix)
+}
+
+func handleDoctor(args []string) {
+	r := &doctorReport{}
+
+	fmt.Printf("%sHost%s\n", ColorBlue, ColorReset)
+	if checkNix(r) {
+		checkFlakes(r)
+	}
+	if checkDirenv(r) {
+		checkDirenvHook(r)
+		checkNixDirenv(r)
+		checkEnvrcAllowed(r)
+	}
+	checkCacheDir(r)
+
+	project := getProject()
+	fmt.Printf("\n%sEnvironments of %s%s\n", ColorBlue, project.Alias, ColorReset)
+	checkProjectEnvs(r, project)
+
+	fmt.Println()
+	switch {
+	case r.problems > 0:
+		fatal(fmt.Sprintf("%d problems and %d warnings found.", r.problems, r.warnings))
+	case r.warnings > 0:
+		fmt.Printf("%sNo problems found, %d warnings.%s\n", ColorYellow, r.warnings, ColorReset)
+	default:
+		fmt.Printf("%sEverything looks good.%s\n", ColorGreen, ColorReset)
+	}
+}
+
+func checkNix(r *doctorReport) bool {
+	if _, err := exec.LookPath("nix"); err != nil {
+		r.fail("nix", "not found on PATH", "install Nix from https://nixos.org/download and open a new shell")
+		return false
+	}
+	out, err := exec.Command("nix", "--version").Output()
+	if err != nil {
+		r.fail("nix", "nix --version failed: "+err.Error(), "check your Nix installation, e.g. that the nix-daemon is running")
+		return false
+	}
+	r.ok("nix", strings.TrimSpace("installed "+string(out)))
+	return true
+}
+
+// checkFlakes checks that flakes are enabled in the nix configuration.
+// nix-envs passes the feature flags itself, but direnv's `use flake` relies
+// on the configuration.
+func checkFlakes(r *doctorReport) {
+	out, err := exec.Command("nix", "--extra-experimental-features", "nix-command", "config", "show", "experimental-features").Output()
+	if err != nil {
+		// Nix before 2.20 has no `nix config`.
+		out, err = exec.Command("nix", "--extra-experimental-features", "nix-command", "show-config").Output()
+	}
+	if err != nil {
+		r.warn("flakes", "could not read the nix configuration", "make sure experimental-features includes nix-command and flakes")
+		return
+	}
+	features := string(out)
+	for _, line := range strings.Split(features, "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok && strings.TrimSpace(key) == "experimental-features" {
+			features = value
+		}
+	}
+	fields := strings.Fields(features)
+	if !contains(fields, "flakes") || !contains(fields, "nix-command") {
+		r.fail("flakes", "not enabled", `add "experimental-features = nix-command flakes" to ~/.config/nix/nix.conf (or /etc/nix/nix.conf)`)
+		return
+	}
+	r.ok("flakes", "enabled")
+}
+
+func checkDirenv(r *doctorReport) bool {
+	if _, err := exec.LookPath("direnv"); err != nil {
+		r.fail("direnv", "not found on PATH", "install it, e.g. nix profile install nixpkgs#direnv")
+		return false
+	}
+	out, err := exec.Command("direnv", "version").Output()
+	if err != nil {
+		r.fail("direnv", "direnv version failed: "+err.Error(), "reinstall direnv")
+		return false
+	}
+	r.ok("direnv", strings.TrimSpace("installed "+string(out)))
+	return true
+}
+
+// checkDirenvHook looks for direnv's hook in the rc file of the user's shell.
+// Variables direnv exports prove the hook runs in this shell.
+func checkDirenvHook(r *doctorReport) {
+	if os.Getenv("DIRENV_DIR") != "" || os.Getenv("DIRENV_WATCHES") != "" {
+		r.ok("direnv hook", "active in this shell")
+		return
+	}
+	home := os.Getenv("HOME")
+	shell := filepath.Base(os.Getenv("SHELL"))
+	var rcFiles []string
+	switch shell {
+	case "bash":
+		rcFiles = []string{filepath.Join(home, ".bashrc"), filepath.Join(home, ".bash_profile"), filepath.Join(home, ".profile")}
+	case "zsh":
+		dir := os.Getenv("ZDOTDIR")
+		if dir == "" {
+			dir = home
+		}
+		rcFiles = []string{filepath.Join(dir, ".zshrc")}
+	case "fish":
+		rcFiles = []string{filepath.Join(home, ".config", "fish", "config.fish")}
+		confd, _ := filepath.Glob(filepath.Join(home, ".config", "fish", "conf.d", "*.fish"))
+		rcFiles = append(rcFiles, confd...)
+	default:
+		r.warn("direnv hook", fmt.Sprintf("cannot tell whether %q loads direnv", shell), "see https://direnv.net/docs/hook.html for your shell")
+		return
+	}
+	for _, path := range rcFiles {
+		if content, err := os.ReadFile(path); err == nil && strings.Contains(string(content), "direnv hook") {
+			r.ok("direnv hook", "found in "+path)
+			return
+		}
+	}
+	r.fail("direnv hook", "not set up for "+shell, fmt.Sprintf(`add 'eval "$(direnv hook %s)"' to %s and open a new shell`, shell, rcFiles[0]))
+}
+
+// checkNixDirenv looks for nix-direnv in direnv's configuration. Without it
+// `use flake` still works, but re-evaluates the flake on every cd and leaves
+// the shell without GC roots.
+func checkNixDirenv(r *doctorReport) {
+	dir := os.Getenv("DIRENV_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(getConfigDir()), "direnv")
+	}
+	candidates := []string{filepath.Join(dir, "direnvrc"), filepath.Join(os.Getenv("HOME"), ".direnvrc"), "/etc/direnv/direnvrc"}
+	for _, lib := range []string{filepath.Join(dir, "lib"), "/etc/direnv/lib"} {
+		files, _ := filepath.Glob(filepath.Join(lib, "*.sh"))
+		candidates = append(candidates, files...)
+	}
+	for _, path := range candidates {
+		content, err := os.ReadFile(path)
+		if err == nil && (strings.Contains(filepath.Base(path), "nix-direnv") || strings.Contains(string(content), "nix-direnv")) {
+			r.ok("nix-direnv", "loaded from "+path)
+			return
+		}
+	}
+	r.warn("nix-direnv", "not found, so shells are re-evaluated on every cd and can be garbage collected",
+		"nix profile install nixpkgs#nix-direnv and add 'source $HOME/.nix-profile/share/nix-direnv/direnvrc' to "+filepath.Join(dir, "direnvrc"))
+}
+
+// checkEnvrcAllowed checks that direnv may load the .envrc of the current
+// project.
+func checkEnvrcAllowed(r *doctorReport) {
+	if _, err := os.Stat(".envrc"); os.IsNotExist(err) {
+		r.warn(".envrc", "none in "+getProjectRoot(), "create an env with nix-envs create, or activate one with nix-envs use <env>")
+		return
+	}
+	out, err := exec.Command("direnv", "status").Output()
+	if err != nil {
+		r.warn(".envrc", "direnv status failed: "+err.Error(), "run direnv allow")
+		return
+	}
+	// direnv prints "Found RC allowed true" or, since 2.33, "Found RC allowed 0".
+	for _, line := range strings.Split(string(out), "\n") {
+		value, ok := strings.CutPrefix(line, "Found RC allowed ")
+		if !ok {
+			continue
+		}
+		if value = strings.TrimSpace(value); value == "true" || value == "0" {
+			r.ok(".envrc", "allowed")
+		} else {
+			r.fail(".envrc", "not allowed, so direnv will not load it", "run direnv allow")
+		}
+		return
+	}
+	r.warn(".envrc", "direnv did not report on it", "run direnv allow")
+}
+
+// checkCacheDir checks that environments can be written to the cache.
+func checkCacheDir(r *doctorReport) {
+	root := getCacheRoot()
+	if err := os.MkdirAll(root, 0755); err != nil {
+		r.fail("cache", err.Error(), fmt.Sprintf("make %s writable, or point XDG_CACHE_HOME elsewhere", filepath.Dir(root)))
+		return
+	}
+	f, err := os.CreateTemp(root, ".doctor-")
+	if err != nil {
+		r.fail("cache", root+" is not writable", fmt.Sprintf("sudo chown -R %s %s", os.Getenv("USER"), root))
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	r.ok("cache", root+" is writable")
+}
+
+// checkProjectEnvs validates the flake of every env of project: that it
+// parses, is locked and that its devShell evaluates for this machine.
+func checkProjectEnvs(r *doctorReport, p project) {
+	envs := loadProjectEnvs(p.ID)
+	if len(envs) == 0 {
+		fmt.Println("No environments.")
+		return
+	}
+	for _, env := range envs {
+		if _, err := readMetadata(env.Dir); err != nil {
+			r.warn(env.Name, "no metadata.json, so update, add and env cannot change it", fmt.Sprintf("nix-envs delete %s and create it again", env.Name))
+			continue
+		}
+		fix := fmt.Sprintf("nix-envs edit %s to fix it, or nix-envs rollback %s to the previous version", env.Name, env.Name)
+		err := checkFlake(env.Dir)
+		switch {
+		case err == errNixMissing:
+			r.warn(env.Name, "flake.nix not checked: nix is not installed", "install nix")
+			continue
+		case err != nil:
+			r.fail(env.Name, "flake.nix does not parse: "+err.Error(), fix)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(env.Dir, "flake.lock")); err != nil {
+			r.warn(env.Name, "flake inputs are not locked", "nix-envs lock --env "+env.Name)
+		}
+		if _, err := exec.LookPath("nix"); err != nil {
+			r.warn(env.Name, "flake.nix parses, but was not evaluated: nix is not installed", "install nix")
+			continue
+		}
+		if err := evalDevShell(env.Dir); err != nil {
+			r.fail(env.Name, "the devShell does not evaluate: "+err.Error(), fix)
+			continue
+		}
+		r.ok(env.Name, "the devShell evaluates for "+hostSystem())
+	}
+}
+
+// evalDevShell evaluates the default devShell of the flake in cacheDir for
+// this machine without building it, catching unknown packages and broken
+// derivations that parsing alone misses.
+func evalDevShell(cacheDir string) error {
+	cmd := exec.Command("nix", "--extra-experimental-features", "nix-command flakes",
+		"eval", "--raw", ".#devShells."+hostSystem()+".default.drvPath")
+	cmd.Dir = cacheDir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s", strings.ReplaceAll(msg, "\n", "\n       "))
+		}
+		return err
+	}
+	return nil
+}
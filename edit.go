@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func handleEdit(args []string) {
+	if len(args) < 1 {
+		fatal("Usage: nix-envs edit <env>")
+	}
+	name := args[0]
+	cacheDir := getCacheDir(getProject().ID, name)
+	flakePath := filepath.Join(cacheDir, "flake.nix")
+
+	original, err := os.ReadFile(flakePath)
+	if os.IsNotExist(err) {
+		fatal("Environment does not exist. Create it first.")
+	}
+	if err != nil {
+		fatal(fmt.Sprintf("Failed to read flake.nix: %v", err))
+	}
+	recordHistory(cacheDir)
+	defer recordHistory(cacheDir)
+
+	for {
+		if err := openEditor(flakePath); err != nil {
+			fatal(err.Error())
+		}
+		edited, err := os.ReadFile(flakePath)
+		if err != nil {
+			fatal(fmt.Sprintf("Failed to read flake.nix: %v", err))
+		}
+		if bytes.Equal(edited, original) {
+			fmt.Println("flake.nix is unchanged.")
+			return
+		}
+
+		err = checkFlake(cacheDir)
+		if err == nil {
+			fmt.Printf("%sSaved %s.%s\n", ColorGreen, flakePath, ColorReset)
+			return
+		}
+		if err == errNixMissing {
+			fmt.Printf("%sWarning: nix is not installed; flake.nix was saved without checking it.%s\n", ColorYellow, ColorReset)
+			return
+		}
+		fmt.Printf("%sflake.nix does not parse: %v%s\n", ColorRed, err, ColorReset)
+
+		switch choose("(r)e-open it, roll (b)ack to the previous content, or (k)eep it anyway?", "r", "b", "k") {
+		case "r":
+			continue
+		case "b":
+			if err := os.WriteFile(flakePath, original, 0644); err != nil {
+				fatal("Failed to restore flake.nix: " + err.Error())
+			}
+			fmt.Println("Rolled back flake.nix.")
+		default:
+			fmt.Printf("%sKept the broken flake.nix; direnv will fail to load it.%s\n", ColorYellow, ColorReset)
+		}
+		return
+	}
+}
+
+// openEditor opens path in $VISUAL or $EDITOR and waits for it to exit.
+// Without either it falls back to xdg-open, which returns right away, so the
+// user is asked to confirm once done.
+func openEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		fmt.Printf("Opening %s with xdg-open...\n", path)
+		cmd := exec.Command("xdg-open", path)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Failed to run xdg-open: %v (set $VISUAL or $EDITOR to use a terminal editor)", err)
+		}
+		fmt.Print("Press Enter when you are done editing.")
+		stdin.ReadString('\n')
+		return nil
+	}
+
+	// Like git, run the editor through the shell so $EDITOR may carry
+	// arguments, e.g. "code --wait".
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Editor %q failed: %v", editor, err)
+	}
+	return nil
+}
+
+var errNixMissing = fmt.Errorf("nix is not installed")
+
+// checkFlake parse-checks the flake.nix in cacheDir with nix-instantiate
+// --parse, or evaluates it with nix flake check when only nix is available.
+func checkFlake(cacheDir string) error {
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("nix-instantiate"); err == nil {
+		cmd = exec.Command("nix-instantiate", "--parse", "flake.nix")
+	} else if _, err := exec.LookPath("nix"); err == nil {
+		cmd = exec.Command("nix", "--extra-experimental-features", "nix-command flakes", "flake", "check", "--no-build")
+	} else {
+		return errNixMissing
+	}
+	cmd.Dir = cacheDir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// choose asks the user to pick one of options, repeating the question until
+// the answer is one of them.
+func choose(prompt string, options ...string) string {
+	for {
+		fmt.Printf("%s [%s] ", prompt, strings.Join(options, "/"))
+		answer, err := stdin.ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if contains(options, answer) {
+			return answer
+		}
+		if err != nil {
+			return options[len(options)-1]
+		}
+	}
+}
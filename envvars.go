@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// handleEnv manages the variables set in an env's shell:
+//
+//	nix-envs env set <env> KEY=VALUE...
+//	nix-envs env unset <env> KEY...
+//	nix-envs env list <env>
+func handleEnv(args []string) {
+	positional, flags := parseFlags(args)
+	usage := "Usage: nix-envs env set <env> KEY=VALUE... | env unset <env> KEY... | env list <env>"
+	if len(positional) < 2 {
+		fatal(usage)
+	}
+	command, name := positional[0], positional[1]
+	cacheDir := getCacheDir(getProject().ID, name)
+	meta, err := readMetadata(cacheDir)
+	if err != nil {
+		fatal("Environment not found, or it has no metadata.json; recreate it first.")
+	}
+
+	next := *meta
+	next.Env = maps.Clone(meta.Env)
+	if next.Env == nil {
+		next.Env = map[string]string{}
+	}
+	switch command {
+	case "list":
+		if len(meta.Env) == 0 {
+			fmt.Printf("No variables set for %s.\n", name)
+		}
+		for _, key := range sortedKeys(meta.Env) {
+			fmt.Printf("%s=%s\n", key, meta.Env[key])
+		}
+		return
+	case "set":
+		if len(positional) < 3 {
+			fatal(usage)
+		}
+		for _, arg := range positional[2:] {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok || !envKeyPattern.MatchString(key) {
+				fatal(fmt.Sprintf("Invalid assignment %q: expected KEY=VALUE", arg))
+			}
+			next.Env[key] = value
+		}
+	case "unset":
+		if len(positional) < 3 {
+			fatal(usage)
+		}
+		for _, key := range positional[2:] {
+			if _, ok := next.Env[key]; !ok {
+				fatal(fmt.Sprintf("%s is not set for %s; only variables set with env set can be unset.", key, name))
+			}
+			delete(next.Env, key)
+		}
+	default:
+		fatal(usage)
+	}
+	if maps.Equal(next.Env, meta.Env) {
+		fmt.Println("flake.nix is unchanged.")
+		return
+	}
+
+	if len(next.Env) == 0 {
+		next.Env = nil
+	}
+	if !regenerateEnv(cacheDir, meta, &next, flags) {
+		return
+	}
+	if err := saveManifestExtras(name, &next); err != nil {
+		fatal(fmt.Sprintf("Failed to write %s: %v", manifestFile, err))
+	}
+	fmt.Printf("%sUpdated the variables of %s.%s\n", ColorGreen, name, ColorReset)
+}
+
+// nixLiteral quotes s as a Nix string that evaluates to s itself, escaping
+// ${ so values taken from the command line are never interpolated.
+func nixLiteral(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`).Replace(s) + `"`
+}
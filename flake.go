@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.nix.tmpl
+var nixTemplateFS embed.FS
+
+// nixTemplates holds the flake every env is written as, the partials it
+// shares with derivations, and the derivations of the built-in templates.
+var nixTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"join":  strings.Join,
+	"lines": func(s string) []string { return strings.Split(strings.TrimRight(s, "\n"), "\n") },
+}).ParseFS(nixTemplateFS, "templates/*.nix.tmpl"))
+
+// executeNix renders one of nixTemplates. They are compiled in, so failing to
+// render one is a bug.
+func executeNix(name string, data any) string {
+	var b strings.Builder
+	if err := nixTemplates.ExecuteTemplate(&b, name, data); err != nil {
+		panic(err)
+	}
+	return b.String()
+}
+
+// flakeSystems are the systems every generated flake targets, in the order
+// they are written out.
+var flakeSystems = []string{"x86_64-linux", "aarch64-linux", "x86_64-darwin", "aarch64-darwin"}
+
+// allSystems returns src for every flake system, for templates that build the
+// same upstream tarball everywhere.
+func allSystems(src source) map[string]source {
+	sources := make(map[string]source, len(flakeSystems))
+	for _, system := range flakeSystems {
+		sources[system] = src
+	}
+	return sources
+}
+
+// sourceSystems lists the systems that have a source, in flakeSystems order.
+func sourceSystems(sources map[string]source) []string {
+	var systems []string
+	for _, system := range flakeSystems {
+		if _, ok := sources[system]; ok {
+			systems = append(systems, system)
+		}
+	}
+	return systems
+}
+
+// requireHostSource fails when sources has nothing for the running machine,
+// since the resulting flake would be useless here.
+func requireHostSource(sources map[string]source, what string) error {
+	host := hostSystem()
+	if _, ok := sources[host]; !ok {
+		return fmt.Errorf("Hash not found for %s. Does this version support %s?", what, host)
+	}
+	return nil
+}
+
+// nixFetchurl renders a fetchurl call for sources with the fetchurl partial.
+// When every system shares one tarball it is fetched directly; otherwise the
+// per-system URL and hash are selected with ${system}.
+func nixFetchurl(sources map[string]source) (string, error) {
+	data, err := newFetchurlData(sources)
+	if err != nil {
+		return "", err
+	}
+	return executeNix("fetchurl", data), nil
+}
+
+// fetchurlData is what the fetchurl partial is rendered with.
+type fetchurlData struct {
+	// Shared is set when every system builds the same tarball.
+	Shared  *source
+	Systems []systemSource
+}
+
+type systemSource struct {
+	System string
+	source
+}
+
+// It fails when sources has nothing for any system flakes are generated for,
+// as with a lock entry recording no sources.
+func newFetchurlData(sources map[string]source) (fetchurlData, error) {
+	var data fetchurlData
+	for _, system := range sourceSystems(sources) {
+		data.Systems = append(data.Systems, systemSource{system, sources[system]})
+	}
+	if len(data.Systems) == 0 {
+		return data, fmt.Errorf("no sources for any of %s", strings.Join(flakeSystems, ", "))
+	}
+	shared := data.Systems[0].source
+	for _, s := range data.Systems {
+		if s.source != shared {
+			return data, nil
+		}
+	}
+	data.Shared = &shared
+	return data, nil
+}
+
+// parseShasums reads a SHASUMS256.txt style listing into a map from file name
+// to hex digest.
+func parseShasums(body string) map[string]string {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 2 {
+			hashes[strings.TrimPrefix(parts[1], "*")] = parts[0]
+		}
+	}
+	return hashes
+}
+
+// nixpkgsBranch is the nixpkgs branch flakes follow unless pinned to a
+// revision.
+const nixpkgsBranch = "nixos-unstable"
+
+// nixpkgsURL is the flake reference for a nixpkgs revision, or for
+// nixpkgsBranch when rev is empty.
+func nixpkgsURL(rev string) string {
+	if rev == "" {
+		rev = nixpkgsBranch
+	}
+	return "github:nixos/nixpkgs/" + rev
+}
+
+// flakeInput is a flake input besides nixpkgs. Inputs that take a nixpkgs
+// input of their own are made to follow ours.
+type flakeInput struct {
+	Name           string
+	URL            string
+	FollowsNixpkgs bool
+}
+
+// envVar is a devShell environment variable; Value is a Nix expression.
+type envVar struct {
+	Name  string
+	Value string
+}
+
+// shellSpec is the template-specific part of a generated flake: the
+// derivations a template builds and the devShell that exposes them. The
+// surrounding flake boilerplate is shared and rendered by renderFlake and
+// renderStack.
+type shellSpec struct {
+	Template    string
+	Description string
+	Inputs      []flakeInput
+	Overlays    []string
+	// Bindings are let-bindings evaluated per system with pkgs in scope,
+	// indented for the devShells let block.
+	Bindings string
+	Packages []string
+	// ExtraPackages is an optional list expression appended to Packages
+	// with ++, for platform-specific packages.
+	ExtraPackages string
+	Env           []envVar
+	ShellHook     string
+	// Systems restricts the flake to the systems with upstream binaries;
+	// nil means every flake system.
+	Systems []string
+	// Flake is a complete flake.nix supplied by a plugin, written as is
+	// instead of being rendered from the fields above.
+	Flake string
+}
+
+// renderFlake produces the flake.nix for a single template, using nixpkgs at
+// the given revision.
+func renderFlake(spec *shellSpec, nixpkgs string) string {
+	if spec.Flake != "" {
+		return spec.Flake
+	}
+	data := newFlakeData(spec.Description, nixpkgs, []*shellSpec{spec})
+	data.Components = []flakeComponent{{Bindings: spec.Bindings}}
+	data.Default = devShellData{
+		Packages:      spec.Packages,
+		ExtraPackages: spec.ExtraPackages,
+		Env:           spec.Env,
+		ShellHook:     spec.ShellHook,
+	}
+	return executeNix("flake.nix.tmpl", data)
+}
+
+// extend adds the packages and variables of extra to the shell, variables in
+// extra overriding the shell's own. extra may be nil.
+func (s *shellSpec) extend(extra *shellSpec) {
+	if extra == nil {
+		return
+	}
+	s.Packages = append(s.Packages, extra.Packages...)
+	s.Env = mergeEnv(s.Env, extra.Env)
+}
+
+// mergeEnv adds vars to env, replacing variables of the same name.
+func mergeEnv(env, vars []envVar) []envVar {
+	for _, v := range vars {
+		env = slices.DeleteFunc(env, func(e envVar) bool { return e.Name == v.Name })
+		env = append(env, v)
+	}
+	return env
+}
+
+// renderStack composes several templates into one flake. Each template's
+// packages become a component shell pulled in with inputsFrom; env attributes
+// and shellHooks are merged in stack order, with later templates overriding
+// variables set by earlier ones. The packages and variables of extra, if any,
+// are added to the default shell last.
+func renderStack(specs []*shellSpec, extra *shellSpec, nixpkgs string) string {
+	var names []string
+	for _, spec := range specs {
+		names = append(names, strings.TrimSuffix(strings.TrimSuffix(spec.Description, " Custom Environment"), " Environment"))
+	}
+	data := newFlakeData("Stacked Environment: "+strings.Join(names, ", "), nixpkgs, specs)
+
+	var hooks []string
+	for _, spec := range specs {
+		shell := stackShellName(spec.Template)
+		data.Components = append(data.Components, flakeComponent{
+			Bindings: spec.Bindings,
+			Name:     shell,
+			Shell:    devShellData{Packages: spec.Packages, ExtraPackages: spec.ExtraPackages},
+		})
+		data.Default.InputsFrom = append(data.Default.InputsFrom, shell)
+
+		data.Default.Env = mergeEnv(data.Default.Env, spec.Env)
+		if spec.ShellHook != "" {
+			hooks = append(hooks, "# "+spec.Template+"\n"+spec.ShellHook)
+		}
+	}
+	if extra != nil {
+		data.Default.Packages = extra.Packages
+		data.Default.Env = mergeEnv(data.Default.Env, extra.Env)
+	}
+	data.Default.ShellHook = strings.Join(hooks, "\n")
+	return executeNix("flake.nix.tmpl", data)
+}
+
+// stackShellName is the let-binding a stacked template's component shell is
+// bound to, e.g. nodejsShell.
+func stackShellName(template string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range template {
+		if r == '-' || r == '_' || r == '.' {
+			upper = true
+			continue
+		}
+		if upper {
+			b.WriteString(strings.ToUpper(string(r)))
+			upper = false
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String() + "Shell"
+}
+
+// flakeData is what templates/flake.nix.tmpl is rendered with.
+type flakeData struct {
+	Description string
+	// Nixpkgs is the flake reference of the nixpkgs input.
+	Nixpkgs    string
+	Inputs     []flakeInput
+	Systems    []string
+	Overlays   []string
+	Components []flakeComponent
+	Default    devShellData
+}
+
+// flakeComponent is one template of a flake: its let-bindings and, in a
+// stack, the shell they are exposed through.
+type flakeComponent struct {
+	Bindings string
+	Name     string
+	Shell    devShellData
+}
+
+// devShellData is what the devShell partial is rendered with.
+type devShellData struct {
+	InputsFrom    []string
+	Packages      []string
+	ExtraPackages string
+	Env           []envVar
+	ShellHook     string
+}
+
+// newFlakeData collects the inputs, overlays and systems of specs. Inputs
+// and overlays are deduplicated; systems are those every spec supports.
+func newFlakeData(description, nixpkgs string, specs []*shellSpec) *flakeData {
+	data := &flakeData{Description: description, Nixpkgs: nixpkgsURL(nixpkgs), Systems: flakeSystems}
+	for _, spec := range specs {
+		for _, in := range spec.Inputs {
+			if !slices.ContainsFunc(data.Inputs, func(i flakeInput) bool { return i.Name == in.Name }) {
+				data.Inputs = append(data.Inputs, in)
+			}
+		}
+		for _, o := range spec.Overlays {
+			if !contains(data.Overlays, o) {
+				data.Overlays = append(data.Overlays, o)
+			}
+		}
+		if spec.Systems != nil {
+			data.Systems = slices.DeleteFunc(slices.Clone(data.Systems), func(s string) bool { return !contains(spec.Systems, s) })
+		}
+	}
+	return data
+}
+
+// derivationData is what the derivation templates of built-in templates,
+// templates/<name>.nix.tmpl, are rendered with.
+type derivationData struct {
+	Version string
+	Src     fetchurlData
+}
+
+// derivation renders the let-binding built-in template name builds its
+// toolchain with, indented for the devShells let block.
+func derivation(name, version string, sources map[string]source) (string, error) {
+	src, err := newFetchurlData(sources)
+	if err != nil {
+		return "", fmt.Errorf("Cannot render %s %s: %v", name, version, err)
+	}
+	text := executeNix(name+".nix.tmpl", derivationData{Version: version, Src: src})
+	return indentNix(strings.TrimSpace(text), "      "), nil
+}
+
+// indentNix prefixes every non-empty line of text with indent.
+func indentNix(text, indent string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = indent + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lockedInput is an input as pinned by a flake.lock.
+type lockedInput struct {
+	Type         string `json:"type"`
+	Owner        string `json:"owner"`
+	Repo         string `json:"repo"`
+	Rev          string `json:"rev"`
+	LastModified int64  `json:"lastModified"`
+}
+
+// describe renders the input for display, e.g.
+// "github:nixos/nixpkgs 5e4fbfb (2024-06-01)".
+func (in lockedInput) describe() string {
+	s := in.Type
+	if in.Owner != "" {
+		s += ":" + in.Owner + "/" + in.Repo
+	}
+	if in.Rev != "" {
+		s += " " + shortRev(in.Rev)
+	}
+	if in.LastModified > 0 {
+		s += " (" + time.Unix(in.LastModified, 0).UTC().Format("2006-01-02") + ")"
+	}
+	return s
+}
+
+func shortRev(rev string) string {
+	if len(rev) > 7 {
+		return rev[:7]
+	}
+	return rev
+}
+
+// readFlakeLock returns the direct inputs pinned by the flake.lock in
+// cacheDir, keyed by input name. Inputs that follow another input are left
+// out.
+func readFlakeLock(cacheDir string) (map[string]lockedInput, error) {
+	data, err := os.ReadFile(filepath.Join(cacheDir, "flake.lock"))
+	if err != nil {
+		return nil, err
+	}
+	var lock struct {
+		Root  string `json:"root"`
+		Nodes map[string]struct {
+			Inputs map[string]json.RawMessage `json:"inputs"`
+			Locked lockedInput                `json:"locked"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("invalid flake.lock in %s: %v", cacheDir, err)
+	}
+
+	inputs := make(map[string]lockedInput)
+	for name, ref := range lock.Nodes[lock.Root].Inputs {
+		var node string
+		if json.Unmarshal(ref, &node) != nil {
+			continue
+		}
+		inputs[name] = lock.Nodes[node].Locked
+	}
+	return inputs, nil
+}
+
+// runNix runs a nix command in cacheDir with flakes enabled, streaming its
+// output.
+func runNix(cacheDir string, args ...string) error {
+	if _, err := exec.LookPath("nix"); err != nil {
+		return fmt.Errorf("nix is not installed")
+	}
+	args = append([]string{"--extra-experimental-features", "nix-command flakes"}, args...)
+	cmd := exec.Command("nix", args...)
+	cmd.Dir = cacheDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// lockFlake writes or refreshes the flake.lock of a generated env so its
+// inputs are pinned as soon as it exists rather than whenever direnv first
+// evaluates it. Failing to lock is not fatal; nix locks lazily on first use.
+func lockFlake(cacheDir string) {
+	fmt.Println("Locking flake inputs...")
+	if err := runNix(cacheDir, "flake", "lock"); err != nil {
+		fmt.Printf("%sWarning: could not lock flake inputs (%v); nix will lock them on first use.%s\n", ColorYellow, err, ColorReset)
+	}
+}
+
+func handleLock(args []string) {
+	positional, flags := parseFlags(args, "--env")
+	project := getProject()
+
+	var envs []projectEnv
+	for _, env := range loadProjectEnvs(project.ID) {
+		if name := flags.value("--env"); name == "" || env.Name == name {
+			envs = append(envs, env)
+		}
+	}
+	if len(envs) == 0 {
+		fatal("Environment not found.")
+	}
+
+	var failed []string
+	for _, env := range envs {
+		if len(positional) > 0 && !hasInputs(env.Dir, positional) {
+			continue
+		}
+		before, _ := readFlakeLock(env.Dir)
+		recordHistory(env.Dir)
+
+		var err error
+		if flags.has("--update") {
+			fmt.Printf("%sUpdating inputs of %s...%s\n", ColorBlue, env.Name, ColorReset)
+			err = runNix(env.Dir, append([]string{"flake", "update"}, positional...)...)
+		} else {
+			fmt.Printf("%sLocking inputs of %s...%s\n", ColorBlue, env.Name, ColorReset)
+			err = runNix(env.Dir, "flake", "lock")
+		}
+		if err != nil {
+			fmt.Printf("%sError: %s: %v%s\n", ColorRed, env.Name, err, ColorReset)
+			failed = append(failed, env.Name)
+			continue
+		}
+		recordHistory(env.Dir)
+
+		after, err := readFlakeLock(env.Dir)
+		if err != nil {
+			continue
+		}
+		for _, name := range sortedKeys(after) {
+			old, had := before[name]
+			switch {
+			case !had:
+				fmt.Printf("  %s: %s\n", name, after[name].describe())
+			case old.Rev != after[name].Rev:
+				fmt.Printf("  %s: %s -> %s\n", name, old.describe(), after[name].describe())
+			}
+		}
+	}
+	if len(failed) > 0 {
+		fatal("Failed to lock: " + strings.Join(failed, ", "))
+	}
+}
+
+// hasInputs reports whether the flake in cacheDir declares every named input.
+func hasInputs(cacheDir string, names []string) bool {
+	content, err := os.ReadFile(filepath.Join(cacheDir, "flake.nix"))
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		if name != "nixpkgs" && !strings.Contains(string(content), name+".url") {
+			return false
+		}
+	}
+	return true
+}
+
+func handleShow(args []string) {
+	if len(args) < 1 {
+		fatal("Usage: nix-envs show <env>")
+	}
+	name := args[0]
+	project := getProject()
+	cacheDir := getCacheDir(project.ID, name)
+
+	var env *projectEnv
+	for _, e := range loadProjectEnvs(project.ID) {
+		if e.Name == name {
+			env = &e
+			break
+		}
+	}
+	if env == nil {
+		fatal("Environment not found.")
+	}
+	meta := env.Meta
+
+	fmt.Printf("Name:      %s\n", name)
+	fmt.Printf("Template:  %s\n", meta.Template)
+	if len(meta.Components) > 0 {
+		for _, c := range meta.Components {
+			fmt.Printf("  %-8s %s", c.Template, c.Version)
+			if c.RequestedVersion != "" && c.RequestedVersion != c.Version {
+				fmt.Printf(" (%s)", c.RequestedVersion)
+			}
+			fmt.Println()
+		}
+	} else {
+		fmt.Printf("Version:   %s", meta.Version)
+		if meta.RequestedVersion != "" && meta.RequestedVersion != meta.Version {
+			fmt.Printf(" (requested %s)", meta.RequestedVersion)
+		}
+		fmt.Println()
+	}
+	if len(meta.Packages) > 0 {
+		fmt.Printf("Packages:  %s\n", strings.Join(meta.Packages, ", "))
+	}
+	if len(meta.Env) > 0 {
+		fmt.Println("Env:")
+		for _, key := range sortedKeys(meta.Env) {
+			fmt.Printf("  %s=%s\n", key, meta.Env[key])
+		}
+	}
+	if systems := sourceSystems(meta.Sources); len(systems) > 0 {
+		fmt.Printf("Systems:   %s\n", strings.Join(systems, ", "))
+	}
+	fmt.Printf("Directory: %s\n", cacheDir)
+	active := "no"
+	if envrcReferences(".", cacheDir) {
+		active = "yes"
+	}
+	fmt.Printf("In .envrc: %s\n", active)
+	if !meta.CreatedAt.IsZero() {
+		fmt.Printf("Created:   %s\n", meta.CreatedAt.Local().Format("2006-01-02 15:04"))
+		fmt.Printf("Updated:   %s\n", meta.UpdatedAt.Local().Format("2006-01-02 15:04"))
+	}
+
+	inputs, err := readFlakeLock(cacheDir)
+	if err != nil {
+		fmt.Println("Inputs:    not locked (run: nix-envs lock --env " + name + ")")
+		return
+	}
+	fmt.Println("Inputs:")
+	for _, input := range sortedKeys(inputs) {
+		fmt.Printf("  %-14s %s\n", input, inputs[input].describe())
+	}
+}
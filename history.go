@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Every state an env's flake has been in is kept under
+// <cache>/.history/<project>/<name>/<timestamp>/, and deleted envs are moved
+// to <cache>/.trash/<project>/<name>/<timestamp>/ rather than removed, so
+// edits, updates and deletes can be undone. Both are pruned to the
+// history_limit and history_days of the user config.
+const (
+	historyDirName = ".history"
+	trashDirName   = ".trash"
+)
+
+// historyFiles are the files of an env that make up one history entry.
+var historyFiles = []string{"flake.nix", metadataFile, "flake.lock"}
+
+// historyTimeFormat names entries so they sort by the time they were saved.
+const historyTimeFormat = "20060102T150405.000000000"
+
+// historyEntry is one saved state of an env.
+type historyEntry struct {
+	Dir     string
+	SavedAt time.Time
+}
+
+// isCacheBookkeeping reports whether a directory in the cache root holds
+// history or trash rather than a project.
+func isCacheBookkeeping(name string) bool {
+	return name == historyDirName || name == trashDirName
+}
+
+// bookkeepingDir is where the history or trash of the env in cacheDir is kept.
+func bookkeepingDir(kind, cacheDir string) string {
+	return filepath.Join(getCacheRoot(), kind, filepath.Base(filepath.Dir(cacheDir)), filepath.Base(cacheDir))
+}
+
+// listEntries returns the entries in dir, newest first.
+func listEntries(dir string) []historyEntry {
+	dirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var entries []historyEntry
+	for _, d := range dirs {
+		savedAt, err := time.Parse(historyTimeFormat, d.Name())
+		if err != nil || !d.IsDir() {
+			continue
+		}
+		entries = append(entries, historyEntry{Dir: filepath.Join(dir, d.Name()), SavedAt: savedAt})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].SavedAt.After(entries[j].SavedAt) })
+	return entries
+}
+
+// recordHistory saves the current state of the env in cacheDir unless it is
+// the state saved last. It is called before and after every change, so the
+// state being replaced is kept even if it was reached outside nix-envs.
+// Failing to record history is reported but not fatal.
+func recordHistory(cacheDir string) {
+	if _, err := os.Stat(filepath.Join(cacheDir, "flake.nix")); err != nil {
+		return
+	}
+	dir := bookkeepingDir(historyDirName, cacheDir)
+	entries := listEntries(dir)
+	if len(entries) > 0 && sameFiles(entries[0].Dir, cacheDir) {
+		return
+	}
+
+	entry := filepath.Join(dir, time.Now().UTC().Format(historyTimeFormat))
+	if err := copyFiles(cacheDir, entry); err != nil {
+		fmt.Printf("%sWarning: could not save history: %v%s\n", ColorYellow, err, ColorReset)
+		return
+	}
+	pruneEntries(dir, true)
+}
+
+// sameFiles reports whether a and b hold identical history files.
+func sameFiles(a, b string) bool {
+	for _, file := range historyFiles {
+		x, errA := os.ReadFile(filepath.Join(a, file))
+		y, errB := os.ReadFile(filepath.Join(b, file))
+		if (errA == nil) != (errB == nil) || !bytes.Equal(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyFiles copies the history files present in src to dst, removing those
+// src lacks.
+func copyFiles(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, file := range historyFiles {
+		data, err := os.ReadFile(filepath.Join(src, file))
+		if os.IsNotExist(err) {
+			os.Remove(filepath.Join(dst, file))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dst, file), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneEntries removes the entries in dir beyond the configured limit or age.
+// With keepNewest set, the newest entry survives regardless of its age.
+func pruneEntries(dir string, keepNewest bool) {
+	cfg, err := loadConfig()
+	if err != nil {
+		cfg = &config{HistoryLimit: defaultHistoryLimit, HistoryDays: defaultHistoryDays}
+	}
+	cutoff := time.Now().Add(-time.Duration(cfg.HistoryDays) * 24 * time.Hour)
+	for i, e := range listEntries(dir) {
+		if keepNewest && i == 0 {
+			continue
+		}
+		if i >= cfg.HistoryLimit || e.SavedAt.Before(cutoff) {
+			os.RemoveAll(e.Dir)
+		}
+	}
+}
+
+// trashEnv moves the env in cacheDir to the trash.
+func trashEnv(cacheDir string) error {
+	recordHistory(cacheDir)
+	dir := bookkeepingDir(trashDirName, cacheDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(cacheDir, filepath.Join(dir, time.Now().UTC().Format(historyTimeFormat))); err != nil {
+		return err
+	}
+	pruneEntries(dir, false)
+	return nil
+}
+
+func handleHistory(args []string) {
+	if len(args) < 1 {
+		fatal("Usage: nix-envs history <env>")
+	}
+	name := args[0]
+	cacheDir := getCacheDir(getProject().ID, name)
+	entries := listEntries(bookkeepingDir(historyDirName, cacheDir))
+	if len(entries) == 0 {
+		fmt.Printf("No history for %s.\n", name)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tSAVED\tVERSION\t")
+	for i, e := range entries {
+		version := "-"
+		if meta, err := readMetadata(e.Dir); err == nil {
+			version = meta.Version
+			if len(meta.Components) > 0 {
+				version = stackSummary(meta.Components)
+			}
+			if len(meta.Packages) > 0 {
+				version += " " + packageSummary(meta.Packages)
+			}
+		}
+		current := ""
+		if sameFiles(e.Dir, cacheDir) {
+			current = "(current)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i, e.SavedAt.Local().Format("2006-01-02 15:04:05"), version, current)
+	}
+	w.Flush()
+	if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
+		fmt.Printf("\n%s was deleted; bring it back with: nix-envs restore %s\n", name, name)
+	}
+}
+
+func handleRollback(args []string) {
+	positional, flags := parseFlags(args)
+	if len(positional) < 1 {
+		fatal("Usage: nix-envs rollback <env> [n] [--yes]")
+	}
+	name := positional[0]
+	cacheDir := getCacheDir(getProject().ID, name)
+	if _, err := os.Stat(filepath.Join(cacheDir, "flake.nix")); err != nil {
+		fatal(fmt.Sprintf("Environment not found. If it was deleted, run: nix-envs restore %s", name))
+	}
+
+	entries := listEntries(bookkeepingDir(historyDirName, cacheDir))
+	n := 1
+	if len(positional) > 1 {
+		var err error
+		if n, err = strconv.Atoi(positional[1]); err != nil || n < 0 {
+			fatal("The entry to roll back to must be a number from nix-envs history.")
+		}
+	} else if len(entries) > 0 && !sameFiles(entries[0].Dir, cacheDir) {
+		// The env changed since it was last saved; undo that change.
+		n = 0
+	}
+	if n >= len(entries) {
+		fatal(fmt.Sprintf("%s has no history entry %d; see nix-envs history %s.", name, n, name))
+	}
+	target := entries[n]
+	if sameFiles(target.Dir, cacheDir) {
+		fmt.Printf("%s is already at entry %d.\n", name, n)
+		return
+	}
+
+	oldFlake, _ := os.ReadFile(filepath.Join(cacheDir, "flake.nix"))
+	newFlake, err := os.ReadFile(filepath.Join(target.Dir, "flake.nix"))
+	if err != nil {
+		fatal("Failed to read history entry: " + err.Error())
+	}
+	printDiff(diffLines(string(oldFlake), string(newFlake)))
+	if !flags.has("--yes") && !confirm(fmt.Sprintf("Roll %s back to the state saved %s?", name, target.SavedAt.Local().Format("2006-01-02 15:04:05"))) {
+		fmt.Println("Aborted.")
+		return
+	}
+
+	recordHistory(cacheDir)
+	if err := copyFiles(target.Dir, cacheDir); err != nil {
+		fatal("Failed to roll back: " + err.Error())
+	}
+	recordHistory(cacheDir)
+	if meta, err := readMetadata(cacheDir); err == nil {
+		if err := updateLock(name, meta); err != nil {
+			fatal(fmt.Sprintf("Failed to write %s: %v", lockFile, err))
+		}
+	}
+	fmt.Printf("%sRolled %s back to the state saved %s.%s\n", ColorGreen, name, target.SavedAt.Local().Format("2006-01-02 15:04:05"), ColorReset)
+}
+
+func handleRestore(args []string) {
+	if len(args) < 1 {
+		fatal("Usage: nix-envs restore <env>")
+	}
+	name := args[0]
+	project := getProject()
+	cacheDir := getCacheDir(project.ID, name)
+	if _, err := os.Stat(cacheDir); err == nil {
+		fatal(fmt.Sprintf("Environment %s exists. Delete it first, or use nix-envs rollback %s.", name, name))
+	}
+
+	trash := bookkeepingDir(trashDirName, cacheDir)
+	entries := listEntries(trash)
+	if len(entries) == 0 {
+		fatal(fmt.Sprintf("No deleted environment %s to restore.", name))
+	}
+	if err := os.MkdirAll(filepath.Dir(cacheDir), 0755); err != nil {
+		fatal("Failed to create cache directory: " + err.Error())
+	}
+	if err := os.Rename(entries[0].Dir, cacheDir); err != nil {
+		fatal("Failed to restore environment: " + err.Error())
+	}
+	os.Remove(trash)
+	recordHistory(cacheDir)
+
+	meta, err := readMetadata(cacheDir)
+	if err == nil {
+		activateEnv(project.ID, name, meta)
+		if err := updateLock(name, meta); err != nil {
+			fatal(fmt.Sprintf("Failed to write %s: %v", lockFile, err))
+		}
+	} else {
+		setupEnvrc(cacheDir)
+	}
+	fmt.Printf("%sRestored %s, deleted %s.%s\n", ColorGreen, name, entries[0].SavedAt.Local().Format("2006-01-02 15:04:05"), ColorReset)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+)
+
+var descriptionPattern = regexp.MustCompile(`description = "[^ "]+ ([^ "]+)`)
+
+type envEntry struct {
+	Project    string
+	Name       string
+	Template   string
+	Version    string
+	Created    string
+	Nixpkgs    string
+	Referenced string
+}
+
+func handleList(args []string) {
+	global := contains(args, "--global")
+	root := getCacheRoot()
+	current := getProject()
+
+	var projects []string
+	if global {
+		dirs, err := os.ReadDir(root)
+		if err != nil && !os.IsNotExist(err) {
+			fatal("Failed to read cache directory: " + err.Error())
+		}
+		for _, d := range dirs {
+			if d.IsDir() && !isCacheBookkeeping(d.Name()) {
+				projects = append(projects, d.Name())
+			}
+		}
+	} else {
+		projects = []string{current.ID}
+	}
+
+	var entries []envEntry
+	for _, project := range projects {
+		entries = append(entries, listProjectEnvs(project, project == current.ID)...)
+	}
+
+	if len(entries) == 0 {
+		if global {
+			fmt.Println("No environments found.")
+		} else {
+			fmt.Printf("No environments found for project %s.\n", current.Alias)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tNAME\tTEMPLATE\tVERSION\tCREATED\tNIXPKGS\tIN .envrc")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Project, e.Name, e.Template, e.Version, e.Created, e.Nixpkgs, e.Referenced)
+	}
+	w.Flush()
+}
+
+// listProjectEnvs collects every environment stored for a project. Whether an
+// env is referenced is checked against the .envrc in the project root recorded
+// in its metadata, falling back to the working directory for the current
+// project when no metadata exists.
+func listProjectEnvs(project string, isCurrent bool) []envEntry {
+	var entries []envEntry
+	for _, env := range loadProjectEnvs(project) {
+		meta := env.Meta
+		entry := envEntry{
+			Project:    project,
+			Name:       env.Name,
+			Template:   meta.Template,
+			Version:    meta.Version,
+			Created:    meta.CreatedAt.Local().Format("2006-01-02 15:04"),
+			Nixpkgs:    "-",
+			Referenced: "?",
+		}
+		if inputs, err := readFlakeLock(env.Dir); err == nil {
+			if nixpkgs, ok := inputs["nixpkgs"]; ok {
+				entry.Nixpkgs = shortRev(nixpkgs.Rev)
+			}
+		}
+		if len(meta.Components) > 0 {
+			entry.Version = stackSummary(meta.Components)
+		} else if meta.RequestedVersion != "" && meta.RequestedVersion != meta.Version {
+			entry.Version += " (" + meta.RequestedVersion + ")"
+		}
+
+		projectRoot := meta.ProjectRoot
+		if projectRoot == "" && isCurrent {
+			projectRoot = "."
+		}
+		if projectRoot != "" {
+			entry.Referenced = "no"
+			if envrcReferences(projectRoot, env.Dir) {
+				entry.Referenced = "yes"
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func envrcReferences(projectRoot, cacheDir string) bool {
+	content, err := os.ReadFile(filepath.Join(projectRoot, ".envrc"))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(content), envrcLine(cacheDir))
+}
+
+// flakeVersion recovers the pinned version from the description line written
+// by the generators, e.g. `description = "NodeJS 20.11.0 Custom Environment"`.
+func flakeVersion(flakePath string) string {
+	content, err := os.ReadFile(flakePath)
+	if err != nil {
+		return "-"
+	}
+	m := descriptionPattern.FindStringSubmatch(string(content))
+	if m == nil {
+		return "-"
+	}
+	version := m[1]
+	if version != "latest" && !unicode.IsDigit(rune(version[0])) {
+		return "-"
+	}
+	return version
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// lockFile records exactly what each env in nix-envs.toml resolved to, so
+// envs can be recreated without re-resolving versions or re-downloading
+// sources, and upgrades show up as reviewable diffs. It is kept next to the
+// manifest and only maintained for projects that have one.
+const lockFile = "nix-envs.lock"
+
+const lockVersion = 1
+
+type projectLock struct {
+	Version int                   `json:"version"`
+	Envs    map[string]*lockedEnv `json:"envs"`
+}
+
+// lockedEnv pins one environment: the resolved version and per-system
+// sources of its template, or of each component for a stack, and the
+// nixpkgs revision its flake was generated against.
+type lockedEnv struct {
+	Template         string            `json:"template"`
+	RequestedVersion string            `json:"requested_version,omitempty"`
+	Version          string            `json:"version,omitempty"`
+	Sources          map[string]source `json:"sources,omitempty"`
+	Components       []envComponent    `json:"components,omitempty"`
+	Nixpkgs          string            `json:"nixpkgs,omitempty"`
+}
+
+// readLock loads the lockfile in the working directory, returning an empty
+// lock if there is none.
+func readLock() (*projectLock, error) {
+	lock := &projectLock{Version: lockVersion, Envs: map[string]*lockedEnv{}}
+	data, err := os.ReadFile(lockFile)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", lockFile, err)
+	}
+	if lock.Version > lockVersion {
+		return nil, fmt.Errorf("%s was written by a newer nix-envs (lock version %d)", lockFile, lock.Version)
+	}
+	if lock.Envs == nil {
+		lock.Envs = map[string]*lockedEnv{}
+	}
+	return lock, nil
+}
+
+func writeLock(lock *projectLock) error {
+	lock.Version = lockVersion
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(lockFile, append(data, '\n'), 0644)
+}
+
+// lockingEnabled reports whether the project keeps a lockfile, i.e. whether
+// it declares its envs in a manifest.
+func lockingEnabled() bool {
+	_, err := os.Stat(manifestFile)
+	return err == nil
+}
+
+// lockEntry pins the environment described by meta.
+func lockEntry(meta *envMetadata) *lockedEnv {
+	return &lockedEnv{
+		Template:         meta.Template,
+		RequestedVersion: meta.RequestedVersion,
+		Version:          meta.Version,
+		Sources:          meta.Sources,
+		Components:       meta.Components,
+		Nixpkgs:          meta.Nixpkgs,
+	}
+}
+
+// satisfies reports whether the pinned env was locked for the same template
+// and requested versions as req, so it can stand in for resolving them again.
+func (l *lockedEnv) satisfies(req envRequest) bool {
+	if len(req.Stack) > 0 {
+		return l.Template == stackTemplate && slices.EqualFunc(req.Stack, l.Components, func(a, b envComponent) bool {
+			return a.Template == b.Template && a.RequestedVersion == b.RequestedVersion
+		})
+	}
+	return l.Template == req.Template && len(l.Components) == 0 && l.RequestedVersion == req.Version
+}
+
+// pins reports whether meta was generated from exactly this lock entry. An
+// entry recording a nixpkgs branch rather than a revision pins nothing.
+func (l *lockedEnv) pins(meta *envMetadata) bool {
+	return l.Version == meta.Version && l.Nixpkgs == meta.Nixpkgs && nixpkgsRevPattern.MatchString(l.Nixpkgs) &&
+		slices.EqualFunc(l.Components, meta.Components, func(a, b envComponent) bool {
+			return a.Template == b.Template && a.Version == b.Version
+		})
+}
+
+// updateLock records meta for env name if the project keeps a lockfile.
+func updateLock(name string, meta *envMetadata) error {
+	if !lockingEnabled() {
+		return nil
+	}
+	lock, err := readLock()
+	if err != nil {
+		return err
+	}
+	lock.Envs[name] = lockEntry(meta)
+	return writeLock(lock)
+}
@@ -6,15 +6,19 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
+	"regexp"
 	"slices"
+	"sort"
 	"strings"
 )
 
+var envNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
 const (
 	ColorReset  = "\033[0m"
 	ColorRed    = "\033[31m"
@@ -32,6 +36,10 @@ func main() {
 	command := os.Args[1]
 	args := os.Args[2:]
 
+	if command != "versions" {
+		migrateLegacyProject(getProject())
+	}
+
 	switch command {
 	case "create":
 		handleCreate(args)
@@ -39,324 +47,517 @@ func main() {
 		handleEdit(args)
 	case "delete":
 		handleDelete(args)
+	case "history":
+		handleHistory(args)
+	case "rollback":
+		handleRollback(args)
+	case "restore":
+		handleRestore(args)
+	case "prune":
+		handlePrune(args)
+	case "doctor":
+		handleDoctor(args)
+	case "list":
+		handleList(args)
+	case "update":
+		handleUpdate(args)
+	case "versions":
+		handleVersions(args)
+	case "init":
+		handleInit(args)
+	case "use":
+		handleUse(args)
+	case "import":
+		handleImport(args)
+	case "export":
+		handleExport(args)
+	case "sync":
+		handleSync(args)
+	case "pin":
+		handlePin(args)
+	case "lock":
+		handleLock(args)
+	case "show":
+		handleShow(args)
+	case "template":
+		handleTemplate(args)
+	case "add":
+		handleAdd(args)
+	case "remove":
+		handleRemove(args)
+	case "env":
+		handleEnv(args)
 	default:
 		showHelp()
 	}
 }
 
 func handleCreate(args []string) {
-	if len(args) < 2 {
-		fatal("Usage: nix-envs create <template> <version> [--track]")
+	positional, flags := parseFlags(args, "--name", "--nixpkgs", "--with")
+	req := envRequest{
+		Name:    flags.value("--name"),
+		Nixpkgs: flags.value("--nixpkgs"),
+		Track:   flags.has("--track"),
+		Save:    flags.has("--save"),
+		Refresh: flags.has("--refresh"),
+	}
+	for _, pkg := range flags["--with"] {
+		attr, err := packageAttr(pkg)
+		if err != nil {
+			fatal(err.Error())
+		}
+		req.Packages = append(req.Packages, attr)
+	}
+	if flags.has("--stack") {
+		components, err := parseStackArgs(positional)
+		if err != nil {
+			fatal(err.Error() + "\nUsage: nix-envs create --stack <template> <version> <template> <version>... [--name <name>]")
+		}
+		req.Stack = components
+	} else {
+		if len(positional) == 0 {
+			handleInit(args)
+			return
+		}
+		if len(positional) < 2 {
+			fatal("Usage: nix-envs create <template> <version> [--name <name>] [--with <pkg>]... [--track] [--save] [--refresh] [--nixpkgs <rev|branch>]")
+		}
+		req.Template, req.Version = positional[0], positional[1]
+	}
+
+	if err := createEnv(req); err != nil {
+		fatal(err.Error())
 	}
+}
 
-	template := args[0]
-	version := args[1]
-	track := contains(args, "--track")
+// envRequest describes an environment to create. Name defaults to the
+// template, so named instances let one project hold several versions of the
+// same template side by side. A request with Stack set composes several
+// templates into one environment instead, named "stack" by default.
+type envRequest struct {
+	Name     string
+	Template string
+	Version  string
+	Stack    []envComponent
+	Track    bool
+	// Inactive envs are left out of .envrc.
+	Inactive bool
+	// Save declares the env in the project manifest.
+	Save bool
+	// Refresh ignores the lockfile and resolves and fetches everything again.
+	Refresh bool
+	// Nixpkgs is a nixpkgs branch or revision to pin the flake to instead of
+	// the configured default.
+	Nixpkgs string
+	// Packages are extra nixpkgs packages for the env's shell, by attribute
+	// path.
+	Packages []string
+	// Env holds variables for the env's shell, over any already set.
+	Env map[string]string
+	// Declared requests come from the manifest, whose packages and variables
+	// replace the ones the env has rather than adding to them.
+	Declared bool
+}
 
-	projectName := getProjectName()
-	cacheDir := getCacheDir(projectName, template)
+// createEnv resolves the requested version, writes the flake and metadata for
+// a template into the cache and activates it in .envrc. In projects with a
+// manifest, versions and sources come from the lockfile when it pins the same
+// request, and the lockfile is updated otherwise.
+func createEnv(req envRequest) error {
+	if len(req.Stack) > 0 {
+		req.Template = stackTemplate
+	}
+	name := req.Name
+	if name == "" {
+		name = req.Template
+	}
+	if !envNamePattern.MatchString(name) {
+		return fmt.Errorf("Invalid environment name %q", name)
+	}
+	for _, template := range requestTemplates(req) {
+		if _, err := lookupTemplate(template); err != nil {
+			return err
+		}
+	}
 
-	fmt.Printf("%sCreating %s environment (%s) for project %s...%s\n", ColorBlue, template, version, projectName, ColorReset)
+	project := getProject()
+	cacheDir := getCacheDir(project.ID, name)
+	existing, err := readMetadata(cacheDir)
+	if err == nil && existing.Template != req.Template {
+		return fmt.Errorf("Environment %s already exists with template %s. Use --name to pick another name.", name, existing.Template)
+	}
 
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		fatal("Failed to create cache directory: " + err.Error())
-	}
-
-	var flakeContent string
-	var err error
-
-	switch template {
-	case "nodejs":
-		flakeContent, err = generateNodeJS(version)
-	case "go":
-		flakeContent, err = generateGo(version)
-	case "rust":
-		flakeContent = generateRust(version)
-	case "python":
-		flakeContent, err = generatePython(version)
-	case "bun":
-		flakeContent, err = generateBun(version)
-	case "lua":
-		flakeContent, err = generateLua(version)
-	case "nix":
-		flakeContent = generateNix()
-	case "elixir":
-		flakeContent, err = generateElixir(version)
-	default:
-		fatal("Unknown template: " + template)
+	locking := req.Save || lockingEnabled()
+	var locked *lockedEnv
+	if locking {
+		lock, err := readLock()
+		if err != nil {
+			return err
+		}
+		if l := lock.Envs[name]; l != nil && !req.Refresh && l.satisfies(req) {
+			locked = l
+		}
+	}
+
+	meta := &envMetadata{
+		Template:         req.Template,
+		RequestedVersion: req.Version,
+		Arch:             hostSystem(),
+		ProjectRoot:      getProjectRoot(),
+	}
+	if existing != nil {
+		// Packages and variables added to an env outlive recreating it.
+		meta.Packages, meta.Env = existing.Packages, existing.Env
+	}
+	if req.Declared {
+		meta.Packages, meta.Env = nil, nil
+	}
+	for _, pkg := range req.Packages {
+		if !contains(meta.Packages, pkg) {
+			meta.Packages = append(meta.Packages, pkg)
+		}
+	}
+	if len(req.Env) > 0 {
+		meta.Env = maps.Clone(meta.Env)
+		if meta.Env == nil {
+			meta.Env = map[string]string{}
+		}
+		maps.Copy(meta.Env, req.Env)
+	}
+	if locked != nil {
+		fmt.Printf("Using versions pinned in %s\n", lockFile)
+	}
+	if locked != nil && req.Nixpkgs == "" && nixpkgsRevPattern.MatchString(locked.Nixpkgs) {
+		meta.Nixpkgs = locked.Nixpkgs
+	} else {
+		rev, err := nixpkgsRevision(req.Nixpkgs, locking)
+		if err != nil {
+			return err
+		}
+		meta.Nixpkgs = rev
 	}
 
+	if len(req.Stack) > 0 {
+		meta.Components = req.Stack
+		if locked != nil {
+			meta.Components = slices.Clone(locked.Components)
+		}
+		fmt.Printf("%sCreating stacked environment %s for project %s...%s\n", ColorBlue, name, project.Alias, ColorReset)
+	} else {
+		if locked != nil {
+			meta.Version, meta.Sources = locked.Version, locked.Sources
+		} else {
+			version, err := resolveVersion(req.Template, req.Version)
+			if err != nil {
+				return err
+			}
+			if version != req.Version {
+				fmt.Printf("Resolved %s %s to %s\n", req.Template, req.Version, version)
+			}
+			meta.Version = version
+		}
+		fmt.Printf("%sCreating %s environment %s (%s) for project %s...%s\n", ColorBlue, req.Template, name, meta.Version, project.Alias, ColorReset)
+	}
+	flakeContent, err := renderEnv(meta)
 	if err != nil {
-		fatal(err.Error())
+		return err
+	}
+
+	recordHistory(cacheDir)
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("Failed to create cache directory: %v", err)
 	}
 
 	flakePath := filepath.Join(cacheDir, "flake.nix")
 	if err := os.WriteFile(flakePath, []byte(flakeContent), 0644); err != nil {
-		fatal("Failed to write flake.nix: " + err.Error())
+		return fmt.Errorf("Failed to write flake.nix: %v", err)
 	}
 
-	setupEnvrc(cacheDir)
-	if !track {
+	if err := writeMetadata(cacheDir, meta); err != nil {
+		return fmt.Errorf("Failed to write metadata.json: %v", err)
+	}
+	lockFlake(cacheDir)
+	recordHistory(cacheDir)
+
+	if !req.Inactive {
+		activateEnv(project.ID, name, meta)
+	}
+	if !req.Track {
 		setupGitIgnore()
 	}
 
+	if req.Save {
+		req.Name = name
+		req.Packages, req.Env = meta.Packages, meta.Env
+		if err := saveManifestEnv(manifestEntry(req)); err != nil {
+			return fmt.Errorf("Failed to write %s: %v", manifestFile, err)
+		}
+		fmt.Printf("Saved to %s\n", manifestFile)
+	}
+	if locking && (locked == nil || !locked.pins(meta)) {
+		if err := updateLock(name, meta); err != nil {
+			return fmt.Errorf("Failed to write %s: %v", lockFile, err)
+		}
+	}
+
 	fmt.Printf("%sSuccess! Environment ready in %s%s\n", ColorGreen, cacheDir, ColorReset)
+	return nil
 }
 
-func handleEdit(args []string) {
-	if len(args) < 1 {
-		fatal("Usage: nix-envs edit <template>")
+// activateEnv adds an environment to .envrc and removes any other env that
+// provides one of the same templates, so only one version of a toolchain is
+// active at a time. A stack conflicts with every env of its components.
+func activateEnv(project, name string, meta *envMetadata) {
+	templates := meta.templates()
+	for _, env := range loadProjectEnvs(project) {
+		if env.Name == name {
+			continue
+		}
+		if slices.ContainsFunc(env.Meta.templates(), func(t string) bool { return contains(templates, t) }) {
+			removeFromEnvrc(env.Dir)
+		}
 	}
-	template := args[0]
-	projectName := getProjectName()
-	flakePath := filepath.Join(getCacheDir(projectName, template), "flake.nix")
+	setupEnvrc(getCacheDir(project, name))
+}
 
-	if _, err := os.Stat(flakePath); os.IsNotExist(err) {
-		fatal("Environment does not exist. Create it first.")
+func handleUse(args []string) {
+	if len(args) < 1 {
+		fatal("Usage: nix-envs use <env>")
 	}
-
-	fmt.Printf("Opening %s with xdg-open...\n", flakePath)
-
-	cmd := exec.Command("xdg-open", flakePath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		fatal(fmt.Sprintf("Failed to run xdg-open: %v", err))
+	name := args[0]
+	project := getProject()
+	meta, err := readMetadata(getCacheDir(project.ID, name))
+	if err != nil {
+		fatal("Environment not found.")
+	}
+	activateEnv(project.ID, name, meta)
+	if len(meta.Components) > 0 {
+		fmt.Printf("%sActivated %s (%s).%s\n", ColorGreen, name, stackSummary(meta.Components), ColorReset)
+	} else {
+		fmt.Printf("%sActivated %s (%s %s).%s\n", ColorGreen, name, meta.Template, meta.Version, ColorReset)
 	}
 }
 
 func handleDelete(args []string) {
 	if len(args) < 1 {
-		fatal("Usage: nix-envs delete <template>")
+		fatal("Usage: nix-envs delete <env>")
+	}
+	name := args[0]
+	if err := deleteEnv(getProject().ID, name); err != nil {
+		fatal(err.Error())
 	}
-	template := args[0]
-	projectName := getProjectName()
-	cacheDir := getCacheDir(projectName, template)
+	fmt.Printf("%sDeleted %s environment. Undo with: nix-envs restore %s%s\n", ColorYellow, name, name, ColorReset)
+}
+
+// deleteEnv moves an environment from the cache to the trash and removes it
+// from .envrc.
+func deleteEnv(project, name string) error {
+	cacheDir := getCacheDir(project, name)
 
 	if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
-		fatal("Environment not found.")
+		return fmt.Errorf("Environment not found.")
 	}
 
-	if err := os.RemoveAll(cacheDir); err != nil {
-		fatal("Failed to delete environment: " + err.Error())
+	if err := trashEnv(cacheDir); err != nil {
+		return fmt.Errorf("Failed to delete environment: %v", err)
 	}
 
 	removeFromEnvrc(cacheDir)
+	return nil
+}
 
-	fmt.Printf("%sDeleted %s environment.%s\n", ColorYellow, template, ColorReset)
+// renderEnv generates an env's flake from its metadata, fetching nothing but
+// sources the metadata lacks, which it records. Packages and variables added
+// to the env are rendered into its default shell.
+func renderEnv(meta *envMetadata) (string, error) {
+	if len(meta.Components) > 0 {
+		specs, err := stackSpecs(meta.Components)
+		if err != nil {
+			return "", err
+		}
+		return renderStack(specs, meta.extraSpec(), meta.Nixpkgs), nil
+	}
+	spec, err := envSpec(meta)
+	if err != nil {
+		return "", err
+	}
+	if spec.Flake != "" && meta.extraSpec() != nil {
+		return "", fmt.Errorf("%s provides a complete flake; packages and variables cannot be added to it", meta.Template)
+	}
+	spec.extend(meta.extraSpec())
+	return renderFlake(spec, meta.Nixpkgs), nil
 }
 
-func generateNodeJS(version string) (string, error) {
-	arch := "linux-x64"
-	if runtime.GOARCH == "arm64" {
-		arch = "linux-arm64"
+// envSpec builds the spec of the single-template env meta, fetching its
+// sources if they are not recorded yet.
+func envSpec(meta *envMetadata) (*shellSpec, error) {
+	if meta.Sources == nil {
+		sources, err := fetchSources(meta.Template, meta.Version)
+		if err != nil {
+			return nil, err
+		}
+		meta.Sources = sources
 	}
+	return buildSpec(meta.Template, meta.Version, meta.Sources)
+}
 
-	fmt.Printf("Fetching hash for Node.js v%s...\n", version)
+var nodeArch = map[string]string{
+	"x86_64-linux":   "linux-x64",
+	"aarch64-linux":  "linux-arm64",
+	"x86_64-darwin":  "darwin-x64",
+	"aarch64-darwin": "darwin-arm64",
+}
+
+func fetchNodeJS(version string) (map[string]source, error) {
+	fmt.Printf("Fetching hashes for Node.js v%s...\n", version)
 	shasumsUrl := fmt.Sprintf("https://nodejs.org/dist/v%s/SHASUMS256.txt", version)
 
-	resp, err := http.Get(shasumsUrl)
-	if err != nil || resp.StatusCode != 200 {
-		return "", fmt.Errorf("Could not find version v%s on nodejs.org (HTTP %d)", version, resp.StatusCode)
+	bodyBytes, err := fetchBody(shasumsUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find version v%s on nodejs.org: %v", version, err)
 	}
-	defer resp.Body.Close()
+	hashes := parseShasums(string(bodyBytes))
+
+	sources := make(map[string]source)
+	for _, system := range flakeSystems {
+		targetFile := fmt.Sprintf("node-v%s-%s.tar.gz", version, nodeArch[system])
+		if hash, ok := hashes[targetFile]; ok {
+			sources[system] = source{
+				URL:    fmt.Sprintf("https://nodejs.org/dist/v%s/%s", version, targetFile),
+				SHA256: hash,
+			}
+		}
+	}
+	if err := requireHostSource(sources, version); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("%sFound hashes for %s%s\n", ColorBlue, strings.Join(sourceSystems(sources), ", "), ColorReset)
 
-	bodyBytes, _ := io.ReadAll(resp.Body)
-	bodyString := string(bodyBytes)
+	return sources, nil
+}
+
+func generateNodeJS(version string, sources map[string]source) (*shellSpec, error) {
+	bindings, err := derivation("nodejs", version, sources)
+	if err != nil {
+		return nil, err
+	}
+	return &shellSpec{
+		Description: fmt.Sprintf("NodeJS %s Custom Environment", version),
+		Systems:     sourceSystems(sources),
+		Bindings:    bindings,
+		Packages: []string{
+			"nodeCustom",
+			"pkgs.typescript-language-server",
+			"pkgs.prettierd",
+			"pkgs.biome",
+			"pkgs.vscode-langservers-extracted",
+			"pkgs.codespell",
+		},
+		Env: []envVar{
+			{"LD_LIBRARY_PATH", "pkgs.lib.optionalString pkgs.stdenv.isLinux (pkgs.lib.makeLibraryPath [ pkgs.libuuid pkgs.stdenv.cc.cc.lib ])"},
+			{"NODE_PATH", `"$out/lib/node_modules"`},
+		},
+		ShellHook: `export COREPACK_HOME="$PWD/.nix-corepack"
+mkdir -p "$COREPACK_HOME/bin"
+[ -f "$COREPACK_HOME/package.json" ] || printf '{"type":"commonjs"}' > "$COREPACK_HOME/package.json"
+export PATH="$COREPACK_HOME/bin:$PATH"
+${nodeCustom}/bin/corepack enable --install-directory "$COREPACK_HOME/bin" >/dev/null 2>&1 || true`,
+	}, nil
+}
 
-	targetFile := fmt.Sprintf("node-v%s-%s.tar.gz", version, arch)
-	hash := ""
+var goArch = map[string]string{
+	"x86_64-linux":   "linux-amd64",
+	"aarch64-linux":  "linux-arm64",
+	"x86_64-darwin":  "darwin-amd64",
+	"aarch64-darwin": "darwin-arm64",
+}
 
-	scanner := bufio.NewScanner(strings.NewReader(bodyString))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, targetFile) {
-			parts := strings.Fields(line)
-			if len(parts) > 0 {
-				hash = parts[0]
-				break
+func fetchGo(version string) (map[string]source, error) {
+	fmt.Printf("Fetching hashes for Go v%s...\n", version)
+
+	sources := make(map[string]source)
+	for _, system := range flakeSystems {
+		filename := fmt.Sprintf("go%s.%s.tar.gz", version, goArch[system])
+		url := "https://dl.google.com/go/" + filename
+		hashBytes, err := fetchBody(url + ".sha256")
+		if err != nil {
+			if system == hostSystem() {
+				return nil, fmt.Errorf("Could not find Go version %s. Checked: %s.sha256", version, url)
 			}
+			continue
 		}
+		sources[system] = source{URL: url, SHA256: strings.TrimSpace(string(hashBytes))}
 	}
-
-	if hash == "" {
-		return "", fmt.Errorf("Hash not found for %s. Does this version support %s?", version, arch)
-	}
-
-	fmt.Printf("%sFound hash: %s%s\n", ColorBlue, hash, ColorReset)
-
-	return fmt.Sprintf(`{
-  description = "NodeJS %s Custom Environment";
-  inputs.nixpkgs.url = "github:nixos/nixpkgs/nixos-unstable";
-  
-  outputs = { self, nixpkgs }: let
-    system = "x86_64-linux";
-    pkgs = import nixpkgs { inherit system; };
-    
-    nodeCustom = pkgs.stdenv.mkDerivation {
-      name = "nodejs-%s";
-      src = pkgs.fetchurl {
-        url = "https://nodejs.org/dist/v%s/node-v%s-%s.tar.gz";
-        sha256 = "%s";
-      };
-      
-      nativeBuildInputs = [ pkgs.autoPatchelfHook ];
-      buildInputs = [ pkgs.stdenv.cc.cc.lib pkgs.libuuid ];
-      
-      installPhase = ''
-        mkdir -p $out
-        cp -r * $out/
-      '';
-    };
-  in {
-    devShells.${system}.default = pkgs.mkShell {
-      packages = [
-        nodeCustom
-        pkgs.typescript-language-server
-        pkgs.prettierd
-        pkgs.biome
-        pkgs.vscode-langservers-extracted
-        pkgs.codespell
-      ];
-      env = {
-        LD_LIBRARY_PATH = pkgs.lib.makeLibraryPath [ pkgs.libuuid pkgs.stdenv.cc.cc.lib ];
-        NODE_PATH = "$out/lib/node_modules";
-      };
-      shellHook = ''
-        export COREPACK_HOME="$PWD/.nix-corepack"
-        mkdir -p "$COREPACK_HOME/bin"
-        [ -f "$COREPACK_HOME/package.json" ] || printf '{"type":"commonjs"}' > "$COREPACK_HOME/package.json"
-        export PATH="$COREPACK_HOME/bin:$PATH"
-        ${nodeCustom}/bin/corepack enable --install-directory "$COREPACK_HOME/bin" >/dev/null 2>&1 || true
-      '';
-    };
-  };
-}`, version, version, version, version, arch, hash), nil
-}
-
-func generateGo(version string) (string, error) {
-	arch := "amd64"
-	if runtime.GOARCH == "arm64" {
-		arch = "arm64"
-	}
-
-	osType := "linux"
-	filename := fmt.Sprintf("go%s.%s-%s.tar.gz", version, osType, arch)
-	hashUrl := fmt.Sprintf("https://dl.google.com/go/%s.sha256", filename)
-
-	fmt.Printf("Fetching hash for Go v%s...\n", version)
-
-	resp, err := http.Get(hashUrl)
-	if err != nil || resp.StatusCode != 200 {
-		return "", fmt.Errorf("Could not find Go version %s. Checked: %s", version, hashUrl)
+	if err := requireHostSource(sources, version); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	hashBytes, _ := io.ReadAll(resp.Body)
-	hash := strings.TrimSpace(string(hashBytes))
-
-	fmt.Printf("%sFound hash: %s%s\n", ColorBlue, hash, ColorReset)
-
-	return fmt.Sprintf(`{
-  description = "Go %s Custom Environment";
-  inputs.nixpkgs.url = "github:nixos/nixpkgs/nixos-unstable";
-
-  outputs = { self, nixpkgs }: let
-    system = "x86_64-linux";
-    pkgs = import nixpkgs { inherit system; };
-
-    goCustom = pkgs.stdenv.mkDerivation {
-      name = "go-%s";
-      src = pkgs.fetchurl {
-        url = "https://dl.google.com/go/%s";
-        sha256 = "%s";
-      };
-
-      dontAutoPatchelf = true;
-      nativeBuildInputs = [ pkgs.autoPatchelfHook ];
-      buildInputs = [ pkgs.stdenv.cc.cc.lib ];
-
-      installPhase = ''
-        mkdir -p $out/share/go
-        cp -r * $out/share/go
-        
-        mkdir -p $out/bin
-        ln -s $out/share/go/bin/go $out/bin/go
-        ln -s $out/share/go/bin/gofmt $out/bin/gofmt
-      '';
-
-      postFixup = ''
-        autoPatchelf $out/bin
-      '';
-    };
-  in {
-    devShells.${system}.default = pkgs.mkShell {
-      packages = [ 
-        goCustom
-        pkgs.gopls
-        pkgs.delve
-        pkgs.go-tools
-        pkgs.vscode-langservers-extracted
-      ];
-
-      shellHook = ''
-        export GOROOT=${goCustom}/share/go
-        export PATH=$GOROOT/bin:$PATH
-      '';
-    };
-  };
-}`, version, version, filename, hash), nil
-}
-
-func generateRust(version string) string {
+	fmt.Printf("%sFound hashes for %s%s\n", ColorBlue, strings.Join(sourceSystems(sources), ", "), ColorReset)
+
+	return sources, nil
+}
+
+func generateGo(version string, sources map[string]source) (*shellSpec, error) {
+	bindings, err := derivation("go", version, sources)
+	if err != nil {
+		return nil, err
+	}
+	return &shellSpec{
+		Description: fmt.Sprintf("Go %s Custom Environment", version),
+		Systems:     sourceSystems(sources),
+		Bindings:    bindings,
+		Packages: []string{
+			"goCustom",
+			"pkgs.gopls",
+			"pkgs.delve",
+			"pkgs.go-tools",
+			"pkgs.vscode-langservers-extracted",
+		},
+		ShellHook: `export GOROOT=${goCustom}/share/go
+export PATH=$GOROOT/bin:$PATH`,
+	}, nil
+}
+
+func generateRust(version string) *shellSpec {
 	rustVer := "pkgs.rust-bin.stable.latest.default"
 	if version != "latest" {
 		rustVer = fmt.Sprintf("pkgs.rust-bin.stable.\"%s\".default", version)
 	}
 
-	return fmt.Sprintf(`{
-  description = "Rust %s Environment";
-  inputs = {
-    nixpkgs.url = "github:NixOS/nixpkgs/nixos-unstable";
-    rust-overlay.url = "github:oxalica/rust-overlay";
-    flake-utils.url = "github:numtide/flake-utils";
-  };
-  outputs = { self, nixpkgs, rust-overlay, flake-utils, ... }:
-    flake-utils.lib.eachDefaultSystem (system: let
-      overlays = [ (import rust-overlay) ];
-      pkgs = import nixpkgs { inherit system overlays; };
-    in {
-      devShells.default = pkgs.mkShell {
-        packages = [ 
-          pkgs.pkg-config 
-          pkgs.openssl 
-          %s 
-          pkgs.rust-analyzer
-          pkgs.vscode-langservers-extracted
-          pkgs.codespell
-        ];
-        env = {
-          PKG_CONFIG_PATH = "${pkgs.openssl.dev}/lib/pkgconfig";
-        };
-      };
-    });
-}`, version, rustVer)
-}
-
-func generatePython(version string) (string, error) {
+	return &shellSpec{
+		Description: fmt.Sprintf("Rust %s Environment", version),
+		Inputs: []flakeInput{
+			{Name: "rust-overlay", URL: "github:oxalica/rust-overlay", FollowsNixpkgs: true},
+		},
+		Overlays: []string{"(import rust-overlay)"},
+		Packages: []string{
+			"pkgs.pkg-config",
+			"pkgs.openssl",
+			rustVer,
+			"pkgs.rust-analyzer",
+			"pkgs.vscode-langservers-extracted",
+			"pkgs.codespell",
+		},
+		Env: []envVar{
+			{"PKG_CONFIG_PATH", `"${pkgs.openssl.dev}/lib/pkgconfig"`},
+		},
+	}
+}
+
+func fetchPython(version string) (map[string]source, error) {
 	url := fmt.Sprintf("https://www.python.org/ftp/python/%s/Python-%s.tar.xz", version, version)
 	fmt.Printf("Fetching Python v%s to calculate hash (this may take a moment)...\n", version)
 
 	resp, err := http.Get(url)
 	if err != nil || resp.StatusCode != 200 {
-		return "", fmt.Errorf("Could not find Python version %s at %s", version, url)
+		return nil, fmt.Errorf("Could not find Python version %s at %s", version, url)
 	}
 	defer resp.Body.Close()
 
 	tmpFile, err := os.CreateTemp("", "python-dl-*")
 	if err != nil {
-		return "", fmt.Errorf("Failed to create temp file: %v", err)
+		return nil, fmt.Errorf("Failed to create temp file: %v", err)
 	}
 	defer os.Remove(tmpFile.Name())
 	defer tmpFile.Close()
@@ -366,161 +567,96 @@ func generatePython(version string) (string, error) {
 
 	size, err := io.Copy(mw, resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("Failed to download Python: %v", err)
+		return nil, fmt.Errorf("Failed to download Python: %v", err)
 	}
 
 	hash := hex.EncodeToString(hasher.Sum(nil))
 	fmt.Printf("%sDownloaded %.2f MB. Hash: %s%s\n", ColorBlue, float64(size)/1024/1024, hash, ColorReset)
 
-	return fmt.Sprintf(`{
-  description = "Python %s Custom Environment";
-  inputs.nixpkgs.url = "github:nixos/nixpkgs/nixos-unstable";
-
-  outputs = { self, nixpkgs }: let
-    system = "x86_64-linux";
-    pkgs = import nixpkgs { inherit system; };
-
-    pythonCustom = pkgs.stdenv.mkDerivation {
-      name = "python-%s";
-      src = pkgs.fetchurl {
-        url = "%s";
-        sha256 = "%s";
-      };
-
-      nativeBuildInputs = [ pkgs.pkg-config ];
-      
-      buildInputs = [ 
-        pkgs.openssl 
-        pkgs.zlib 
-        pkgs.libffi 
-        pkgs.readline 
-        pkgs.sqlite 
-        pkgs.bzip2 
-        pkgs.ncurses
-        pkgs.xz
-      ];
-
-      configureFlags = [ "--enable-optimizations" ];
-
-      preConfigure = ''
-        export LD_LIBRARY_PATH=${pkgs.lib.makeLibraryPath [ pkgs.openssl pkgs.zlib pkgs.stdenv.cc.cc.lib ]}:$LD_LIBRARY_PATH
-      '';
-    };
-  in {
-    devShells.${system}.default = pkgs.mkShell {
-      packages = [ 
-        pythonCustom
-        pkgs.python3Packages.pip
-        pkgs.python3Packages.virtualenv
-        pkgs.vscode-langservers-extracted
-        pkgs.codespell
-      ];
-      
-      env = {
-        LD_LIBRARY_PATH = pkgs.lib.makeLibraryPath [ pkgs.openssl pkgs.zlib pkgs.stdenv.cc.cc.lib ];
-      };
-    };
-  };
-}`, version, version, url, hash), nil
-}
-
-func generateBun(version string) (string, error) {
-	arch := "x64"
-	if runtime.GOARCH == "arm64" {
-		arch = "aarch64"
-	}
-
-	fmt.Printf("Fetching hash for Bun v%s...\n", version)
-	shasumsUrl := fmt.Sprintf("https://github.com/oven-sh/bun/releases/download/bun-v%s/SHASUMS256.txt", version)
+	return allSystems(source{URL: url, SHA256: hash}), nil
+}
 
-	resp, err := http.Get(shasumsUrl)
-	if err != nil || resp.StatusCode != 200 {
-		return "", fmt.Errorf("Could not find Bun version v%s (HTTP %d)", version, resp.StatusCode)
-	}
-	defer resp.Body.Close()
+func generatePython(version string, sources map[string]source) (*shellSpec, error) {
+	bindings, err := derivation("python", version, sources)
+	if err != nil {
+		return nil, err
+	}
+	return &shellSpec{
+		Description: fmt.Sprintf("Python %s Custom Environment", version),
+		Bindings:    bindings,
+		Packages: []string{
+			"pythonCustom",
+			"pkgs.python3Packages.pip",
+			"pkgs.python3Packages.virtualenv",
+			"pkgs.vscode-langservers-extracted",
+			"pkgs.codespell",
+		},
+		Env: []envVar{
+			{"LD_LIBRARY_PATH", "pkgs.lib.makeLibraryPath [ pkgs.openssl pkgs.zlib pkgs.stdenv.cc.cc.lib ]"},
+		},
+	}, nil
+}
 
-	bodyBytes, _ := io.ReadAll(resp.Body)
-	bodyString := string(bodyBytes)
+var bunArch = map[string]string{
+	"x86_64-linux":   "linux-x64",
+	"aarch64-linux":  "linux-aarch64",
+	"x86_64-darwin":  "darwin-x64",
+	"aarch64-darwin": "darwin-aarch64",
+}
 
-	targetFile := fmt.Sprintf("bun-linux-%s.zip", arch)
-	hash := ""
+func fetchBun(version string) (map[string]source, error) {
+	fmt.Printf("Fetching hashes for Bun v%s...\n", version)
+	shasumsUrl := fmt.Sprintf("https://github.com/oven-sh/bun/releases/download/bun-v%s/SHASUMS256.txt", version)
 
-	scanner := bufio.NewScanner(strings.NewReader(bodyString))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, targetFile) {
-			parts := strings.Fields(line)
-			if len(parts) > 0 {
-				hash = parts[0]
-				break
+	bodyBytes, err := fetchBody(shasumsUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find Bun version v%s: %v", version, err)
+	}
+	hashes := parseShasums(string(bodyBytes))
+
+	sources := make(map[string]source)
+	for _, system := range flakeSystems {
+		targetFile := fmt.Sprintf("bun-%s.zip", bunArch[system])
+		if hash, ok := hashes[targetFile]; ok {
+			sources[system] = source{
+				URL:    fmt.Sprintf("https://github.com/oven-sh/bun/releases/download/bun-v%s/%s", version, targetFile),
+				SHA256: hash,
 			}
 		}
 	}
+	if err := requireHostSource(sources, version); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("%sFound hashes for %s%s\n", ColorBlue, strings.Join(sourceSystems(sources), ", "), ColorReset)
+
+	return sources, nil
+}
 
-	if hash == "" {
-		return "", fmt.Errorf("Hash not found for %s. Does this version support %s?", version, arch)
-	}
-
-	fmt.Printf("%sFound hash: %s%s\n", ColorBlue, hash, ColorReset)
-
-	return fmt.Sprintf(`{
-  description = "Bun %s Environment";
-  inputs.nixpkgs.url = "github:nixos/nixpkgs/nixos-unstable";
-
-  outputs = { self, nixpkgs }: let
-    system = "x86_64-linux";
-    pkgs = import nixpkgs { inherit system; };
-    
-    bunCustom = pkgs.stdenv.mkDerivation {
-      name = "bun-%s";
-      src = pkgs.fetchurl {
-        url = "https://github.com/oven-sh/bun/releases/download/bun-v%s/bun-linux-%s.zip";
-        sha256 = "%s";
-      };
-
-      nativeBuildInputs = [ pkgs.unzip pkgs.autoPatchelfHook ];
-
-      installPhase = ''
-        mkdir -p $out/bin
-        cp bun $out/bin/
-        chmod +x $out/bin/bun
-      '';
-    };
-  in {
-    devShells.${system}.default = pkgs.mkShell {
-      packages = [ 
-        bunCustom
-        pkgs.typescript-language-server
-        pkgs.prettierd
-        pkgs.biome
-        pkgs.vscode-langservers-extracted
-        pkgs.codespell
-      ];
-    };
-  };
-}`, version, version, version, arch, hash), nil
-}
-
-func generateLua(version string) (string, error) {
+func generateBun(version string, sources map[string]source) (*shellSpec, error) {
+	bindings, err := derivation("bun", version, sources)
+	if err != nil {
+		return nil, err
+	}
+	return &shellSpec{
+		Description: fmt.Sprintf("Bun %s Environment", version),
+		Systems:     sourceSystems(sources),
+		Bindings:    bindings,
+		Packages: []string{
+			"bunCustom",
+			"pkgs.typescript-language-server",
+			"pkgs.prettierd",
+			"pkgs.biome",
+			"pkgs.vscode-langservers-extracted",
+			"pkgs.codespell",
+		},
+	}, nil
+}
+
+func fetchLua(version string) (map[string]source, error) {
 	if version == "neovim" {
 		fmt.Printf("%sDetected Neovim dev environment request. Skipping Lua compilation.%s\n", ColorBlue, ColorReset)
-		return `{
-  description = "Neovim/Lua Development Environment";
-  inputs.nixpkgs.url = "github:nixos/nixpkgs/nixos-unstable";
-
-  outputs = { self, nixpkgs }: let
-    system = "x86_64-linux";
-    pkgs = import nixpkgs { inherit system; };
-  in {
-    devShells.${system}.default = pkgs.mkShell {
-      packages = [
-        pkgs.lua-language-server
-        pkgs.stylua
-        pkgs.codespell
-      ];
-    };
-  };
-}`, nil
+		return nil, nil
 	}
 
 	url := fmt.Sprintf("https://www.lua.org/ftp/lua-%s.tar.gz", version)
@@ -528,13 +664,13 @@ func generateLua(version string) (string, error) {
 
 	resp, err := http.Get(url)
 	if err != nil || resp.StatusCode != 200 {
-		return "", fmt.Errorf("Could not find Lua version %s at %s", version, url)
+		return nil, fmt.Errorf("Could not find Lua version %s at %s", version, url)
 	}
 	defer resp.Body.Close()
 
 	tmpFile, err := os.CreateTemp("", "lua-dl-*")
 	if err != nil {
-		return "", fmt.Errorf("Failed to create temp file: %v", err)
+		return nil, fmt.Errorf("Failed to create temp file: %v", err)
 	}
 	defer os.Remove(tmpFile.Name())
 	defer tmpFile.Close()
@@ -544,163 +680,114 @@ func generateLua(version string) (string, error) {
 
 	size, err := io.Copy(mw, resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("Failed to download Lua: %v", err)
+		return nil, fmt.Errorf("Failed to download Lua: %v", err)
 	}
 
 	hash := hex.EncodeToString(hasher.Sum(nil))
 	fmt.Printf("%sDownloaded %.2f MB. Hash: %s%s\n", ColorBlue, float64(size)/1024/1024, hash, ColorReset)
 
-	return fmt.Sprintf(`{
-  description = "Lua %s Custom Environment";
-  inputs.nixpkgs.url = "github:nixos/nixpkgs/nixos-unstable";
-
-  outputs = { self, nixpkgs }: let
-    system = "x86_64-linux";
-    pkgs = import nixpkgs { inherit system; };
-
-    luaCustom = pkgs.stdenv.mkDerivation {
-      name = "lua-%s";
-      src = pkgs.fetchurl {
-        url = "%s";
-        sha256 = "%s";
-      };
-
-      buildInputs = [ pkgs.readline ];
-      
-      buildPhase = ''
-        make linux
-      '';
-
-      installPhase = ''
-        make install INSTALL_TOP=$out
-      '';
-    };
-  in {
-    devShells.${system}.default = pkgs.mkShell {
-      packages = [
-        luaCustom
-        pkgs.lua-language-server
-        pkgs.stylua
-        pkgs.codespell
-      ];
-    };
-  };
-}`, version, version, url, hash), nil
-}
-
-func generateNix() string {
-	return `{
-  description = "Nix Development Environment";
-  inputs.nixpkgs.url = "github:nixos/nixpkgs/nixos-unstable";
-
-  outputs = { self, nixpkgs }: let
-    system = "x86_64-linux";
-    pkgs = import nixpkgs { inherit system; };
-  in {
-    devShells.${system}.default = pkgs.mkShell {
-      packages = [
-        pkgs.alejandra
-      ];
-    };
-  };
-}`
-}
-
-func generateElixir(version string) (string, error) {
+	return allSystems(source{URL: url, SHA256: hash}), nil
+}
+
+func generateLua(version string, sources map[string]source) (*shellSpec, error) {
+	if version == "neovim" {
+		return &shellSpec{
+			Description: "Neovim/Lua Development Environment",
+			Packages: []string{
+				"pkgs.lua-language-server",
+				"pkgs.stylua",
+				"pkgs.codespell",
+			},
+		}, nil
+	}
+
+	bindings, err := derivation("lua", version, sources)
+	if err != nil {
+		return nil, err
+	}
+	return &shellSpec{
+		Description: fmt.Sprintf("Lua %s Custom Environment", version),
+		Bindings:    bindings,
+		Packages: []string{
+			"luaCustom",
+			"pkgs.lua-language-server",
+			"pkgs.stylua",
+			"pkgs.codespell",
+		},
+	}, nil
+}
+
+func generateNix() *shellSpec {
+	return &shellSpec{
+		Description: "Nix Development Environment",
+		Packages:    []string{"pkgs.alejandra"},
+	}
+}
+
+func fetchElixir(version string) (map[string]source, error) {
 	url := fmt.Sprintf("https://github.com/elixir-lang/elixir/archive/refs/tags/v%s.tar.gz", version)
 	fmt.Printf("Fetching Elixir v%s for hash calculation...\n", version)
 
 	resp, err := http.Get(url)
 	if err != nil || resp.StatusCode != 200 {
-		return "", fmt.Errorf("could not find Elixir v%s", version)
+		return nil, fmt.Errorf("could not find Elixir v%s", version)
 	}
 	defer resp.Body.Close()
 
 	hasher := sha256.New()
 	if _, err := io.Copy(hasher, resp.Body); err != nil {
-		return "", err
+		return nil, err
 	}
 	hash := hex.EncodeToString(hasher.Sum(nil))
 
-	return fmt.Sprintf(`{
-  description = "Elixir %s Custom Environment";
-  inputs.nixpkgs.url = "github:nixos/nixpkgs/nixos-unstable";
-
-  outputs = { self, nixpkgs }: let
-    system = "x86_64-linux";
-    pkgs = import nixpkgs { inherit system; };
-
-    elixirCustom = pkgs.stdenv.mkDerivation {
-      pname = "elixir";
-      version = "%s";
-      src = pkgs.fetchurl {
-        url = "%s";
-        sha256 = "%s";
-      };
-
-      nativeBuildInputs = [ pkgs.makeWrapper ];
-      buildInputs = [ pkgs.erlang_26 ];
-
-      buildPhase = "make";
-      installPhase = ''
-        mkdir -p $out
-        cp -r bin lib man %s $out/
-      '';
-    };
-  in {
-    devShells.${system}.default = pkgs.mkShell {
-      packages = [
-        elixirCustom
-        pkgs.erlang_26
-        pkgs.elixir-ls
-        pkgs.inotify-tools
-      ];
-      shellHook = ''
-        export HEX_HOME=$PWD/.nix-hex
-        export MIX_HOME=$PWD/.nix-mix
-        export PATH=$MIX_HOME/bin:$HEX_HOME/bin:$PATH
-        mkdir -p $HEX_HOME $MIX_HOME
-      '';
-    };
-  };
-}`, version, version, url, hash, "${out}"), nil
-}
-
-func getProjectName() string {
-	cmd := exec.Command("git", "rev-parse", "--git-common-dir")
-	output, err := cmd.Output()
-	if err == nil {
-		path := strings.TrimSpace(string(output))
-		absPath, _ := filepath.Abs(path)
-
-		base := filepath.Base(absPath)
-		if base == ".git" {
-			return filepath.Base(filepath.Dir(absPath))
-		}
-		return strings.TrimSuffix(base, ".git")
-	}
+	return allSystems(source{URL: url, SHA256: hash}), nil
+}
 
-	wd, _ := os.Getwd()
-	return filepath.Base(wd)
+func generateElixir(version string, sources map[string]source) (*shellSpec, error) {
+	bindings, err := derivation("elixir", version, sources)
+	if err != nil {
+		return nil, err
+	}
+	return &shellSpec{
+		Description: fmt.Sprintf("Elixir %s Custom Environment", version),
+		Bindings:    bindings,
+		Packages: []string{
+			"elixirCustom",
+			"pkgs.erlang_26",
+			"pkgs.elixir-ls",
+		},
+		ExtraPackages: "pkgs.lib.optionals pkgs.stdenv.isLinux [ pkgs.inotify-tools ]",
+		ShellHook: `export HEX_HOME=$PWD/.nix-hex
+export MIX_HOME=$PWD/.nix-mix
+export PATH=$MIX_HOME/bin:$HEX_HOME/bin:$PATH
+mkdir -p $HEX_HOME $MIX_HOME`,
+	}, nil
 }
 
-func getCacheDir(project, template string) string {
+func getCacheRoot() string {
 	home := os.Getenv("HOME")
 	xdg := os.Getenv("XDG_CACHE_HOME")
 	if xdg == "" {
 		xdg = filepath.Join(home, ".cache")
 	}
-	return filepath.Join(xdg, "envs", project, template)
+	return filepath.Join(xdg, "envs")
 }
 
-func setupEnvrc(targetDir string) {
+func getCacheDir(project, name string) string {
+	return filepath.Join(getCacheRoot(), project, name)
+}
+
+func envrcLine(targetDir string) string {
 	home := os.Getenv("HOME")
 	displayPath := targetDir
 	if trimmed, ok := strings.CutPrefix(targetDir, home); ok {
 		displayPath = "$HOME" + trimmed
 	}
+	return fmt.Sprintf("use flake \"%s\"", displayPath)
+}
 
-	line := fmt.Sprintf("use flake \"%s\"", displayPath)
+func setupEnvrc(targetDir string) {
+	line := envrcLine(targetDir)
 	file, err := os.OpenFile(".envrc", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		fatal("Could not open .envrc")
@@ -712,19 +799,38 @@ func setupEnvrc(targetDir string) {
 			fatal("Failed to write to .envrc")
 		}
 		fmt.Println("Added entry to .envrc")
-		exec.Command("direnv", "allow").Run()
+		allowEnvrc(".")
 	}
 }
 
-func removeFromEnvrc(targetDir string) {
-	home := os.Getenv("HOME")
-	displayPath := targetDir
-	if trimmed, ok := strings.CutPrefix(targetDir, home); ok {
-		displayPath = "$HOME" + trimmed
+// allowEnvrc approves the .envrc in dir after nix-envs changed it, since
+// direnv refuses to load an .envrc edited since it was last allowed.
+func allowEnvrc(dir string) {
+	if _, err := exec.LookPath("direnv"); err != nil {
+		fmt.Printf("%sWarning: direnv is not installed, so .envrc will not be loaded; run nix-envs doctor.%s\n", ColorYellow, ColorReset)
+		return
 	}
+	cmd := exec.Command("direnv", "allow")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		fmt.Printf("%sWarning: direnv allow failed: %s; run nix-envs doctor.%s\n", ColorYellow, msg, ColorReset)
+	}
+}
 
-	lineToRemove := fmt.Sprintf("use flake \"%s\"", displayPath)
-	input, err := os.ReadFile(".envrc")
+func removeFromEnvrc(targetDir string) {
+	removeFromProjectEnvrc(".", targetDir)
+}
+
+// removeFromProjectEnvrc removes an environment from the .envrc of the project
+// in projectRoot.
+func removeFromProjectEnvrc(projectRoot, targetDir string) {
+	path := filepath.Join(projectRoot, ".envrc")
+	lineToRemove := envrcLine(targetDir)
+	input, err := os.ReadFile(path)
 	if err != nil {
 		return
 	}
@@ -743,9 +849,9 @@ func removeFromEnvrc(targetDir string) {
 		if len(output) > 0 {
 			output += "\n"
 		}
-		os.WriteFile(".envrc", []byte(output), 0644)
+		os.WriteFile(path, []byte(output), 0644)
 		fmt.Println("Removed entry from .envrc")
-		exec.Command("direnv", "allow").Run()
+		allowEnvrc(projectRoot)
 	}
 }
 
@@ -789,12 +895,108 @@ func contains(slice []string, item string) bool {
 	return slices.Contains(slice, item)
 }
 
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type flagSet map[string][]string
+
+// parseFlags separates positional arguments from --flags. Flags named in
+// valueFlags take the next argument (or the part after "=") as their value.
+func parseFlags(args []string, valueFlags ...string) ([]string, flagSet) {
+	var positional []string
+	flags := flagSet{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !hasValue && contains(valueFlags, name) && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		flags[name] = append(flags[name], value)
+	}
+	return positional, flags
+}
+
+func (f flagSet) has(name string) bool {
+	_, ok := f[name]
+	return ok
+}
+
+func (f flagSet) value(name string) string {
+	values := f[name]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 func showHelp() {
 	fmt.Println("Usage: nix-envs [command] [template] [version]")
 	fmt.Println("\nCommands:")
-	fmt.Println("  create <tmpl> <ver>   Create environment (e.g., nodejs 20.11.0)")
-	fmt.Println("  edit <tmpl>            Edit the flake")
-	fmt.Println("  delete <tmpl>          Remove environment")
+	fmt.Println("  create <tmpl> <ver>   Create environment (e.g., nodejs 20.11.0, nodejs lts, go 1.22)")
+	fmt.Println("    --name <name>         Name the env to keep several versions of a template")
+	fmt.Println("  create --stack <tmpl> <ver> <tmpl> <ver>...")
+	fmt.Println("                         Compose several templates into one devShell")
+	fmt.Println("    --save                Also declare the env in nix-envs.toml")
+	fmt.Println("    --refresh             Ignore nix-envs.lock and resolve versions again")
+	fmt.Println("    --nixpkgs <ref>       Pin nixpkgs to a branch or revision")
+	fmt.Println("    --with <pkg>          Add a nixpkgs package to the shell (repeatable)")
+	fmt.Println("  sync [--yes]           Create, update and remove envs to match nix-envs.toml")
+	fmt.Println("    --refresh             Recreate every env and rewrite nix-envs.lock")
+	fmt.Println("  init [--yes]           Detect toolchains from project files and create envs")
+	fmt.Println("  import [--yes]         Create envs from .tool-versions / mise.toml")
+	fmt.Println("  export [--format f]    Write envs to .tool-versions (default) or mise.toml")
+	fmt.Println("  pin [rev|branch]       Move every env of this project to one nixpkgs revision")
+	fmt.Println("  use <env>              Activate an env, deactivating other instances of its template")
+	fmt.Println("  show <env>             Show an env's versions and locked flake inputs")
+	fmt.Println("  lock [--update [input]] [--env <env>]")
+	fmt.Println("                         Lock flake inputs, or update them, for every env")
+	fmt.Println("  add <env> <pkg>...     Add nixpkgs packages to an env's shell")
+	fmt.Println("  remove <env> <pkg>...  Remove packages added with --with or add")
+	fmt.Println("  env set <env> KEY=VAL  Set variables in an env's shell (also: env unset, env list)")
+	fmt.Println("  edit <env>             Edit the flake in $VISUAL/$EDITOR and check it still parses")
+	fmt.Println("  delete <env>           Remove environment (kept in the trash for restore)")
+	fmt.Println("  history <env>          List saved versions of an env's flake")
+	fmt.Println("  rollback <env> [n]     Restore entry n of the history (default: the previous one)")
+	fmt.Println("  restore <env>          Bring back a deleted env")
+	fmt.Println("  list [--global]        List environments for this project (or all)")
+	fmt.Println("  prune [--yes]          Delete envs of gone projects, unused envs and old trash")
+	fmt.Println("    --older-than <days>   Also prune inactive instances unchanged this long")
+	fmt.Println("    --gc-roots            Remove direnv's profiles so nix can collect garbage")
+	fmt.Println("  update <env> [ver]     Regenerate env (default: latest patch of current minor)")
+	fmt.Println("  update <stack> [tmpl ver]...  Update a stack's components")
+	fmt.Println("  versions <tmpl> [pfx]  List upstream versions for this machine [--json]")
+	fmt.Println("  template show <name>   Print a template's Nix source (or flake, partials)")
+	fmt.Println("  doctor                 Check nix, flakes, direnv and this project's envs")
+	fmt.Println("\nTemplates:")
+	for _, t := range allTemplates() {
+		// Plugins are only run when used, not to describe them here.
+		if p, ok := t.(*pluginTemplate); ok {
+			fmt.Printf("  %-22s Plugin %s (nix-envs template show %s)\n", p.name, p.path, p.name)
+			continue
+		}
+		fmt.Printf("  %-22s %s\n", t.Name(), t.Description())
+	}
+	fmt.Printf("\nCustom templates are read from %s and from %s<name> executables on PATH.\n", userTemplatesDir(), pluginPrefix)
 }
 
 func fatal(msg string) {
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// manifestFile declares a project's environments so they can be committed
+// and recreated on any machine with `nix-envs sync`:
+//
+//	[envs.nodejs]
+//	version = "20"
+//
+//	[envs.legacy]
+//	template = "nodejs"
+//	version = "18.19.0"
+//	active = false
+//
+//	[envs.stack]
+//	stack = ["python 3.12", "go 1.22"]
+//	packages = ["postgresql"]
+//	env = { DATABASE_URL = "postgres://localhost/app" }
+const manifestFile = "nix-envs.toml"
+
+// manifestEnv is one [envs.<name>] table of the manifest.
+type manifestEnv struct {
+	Name     string
+	Template string
+	Version  string
+	Stack    []string
+	Track    bool
+	// Inactive envs are created but left out of .envrc.
+	Inactive bool
+	// Packages are nixpkgs packages added to the shell with --with or add.
+	Packages []string
+	// Env holds variables set with `env set`.
+	Env map[string]string
+}
+
+// readManifest parses the manifest in the working directory, returning its
+// envs sorted by name.
+func readManifest() ([]manifestEnv, error) {
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseTOML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", manifestFile, err)
+	}
+
+	var envs []manifestEnv
+	for _, table := range sortedKeys(doc) {
+		name, ok := strings.CutPrefix(table, "envs.")
+		if !ok {
+			continue
+		}
+		if parent, ok := strings.CutSuffix(name, ".env"); ok && doc[`envs.`+parent] != nil {
+			// The variables of env parent, read with it.
+			continue
+		}
+		values := doc[table]
+		env := manifestEnv{
+			Name:     name,
+			Template: doc.str(table, "template"),
+			Version:  doc.str(table, "version"),
+		}
+		if env.Template == "" {
+			env.Template = name
+		}
+		env.Track, _ = values["track"].(bool)
+		if active, ok := values["active"].(bool); ok {
+			env.Inactive = !active
+		}
+		if stack, ok := values["stack"].([]any); ok {
+			for _, s := range stack {
+				component, _ := s.(string)
+				env.Stack = append(env.Stack, component)
+			}
+		}
+		if packages, ok := values["packages"].([]any); ok {
+			for _, p := range packages {
+				pkg, _ := p.(string)
+				attr, err := packageAttr(pkg)
+				if err != nil {
+					return nil, fmt.Errorf("%s: env %s: %v", manifestFile, name, err)
+				}
+				env.Packages = append(env.Packages, attr)
+			}
+		}
+		for key, v := range doc[table+".env"] {
+			value, ok := v.(string)
+			if !ok || !envKeyPattern.MatchString(key) {
+				return nil, fmt.Errorf("%s: env %s: variable %s must be a string", manifestFile, name, key)
+			}
+			if env.Env == nil {
+				env.Env = map[string]string{}
+			}
+			env.Env[key] = value
+		}
+
+		if !envNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%s: invalid environment name %q", manifestFile, name)
+		}
+		if env.Stack == nil && env.Version == "" {
+			return nil, fmt.Errorf("%s: env %s has no version", manifestFile, name)
+		}
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// request turns a manifest entry into the request createEnv expects.
+func (m manifestEnv) request() (envRequest, error) {
+	req := envRequest{Name: m.Name, Track: m.Track, Inactive: m.Inactive, Packages: m.Packages, Env: m.Env, Declared: true}
+	if m.Stack == nil {
+		req.Template, req.Version = m.Template, m.Version
+		return req, nil
+	}
+	var args []string
+	for _, component := range m.Stack {
+		args = append(args, strings.Fields(component)...)
+	}
+	components, err := parseStackArgs(args)
+	if err != nil {
+		return req, fmt.Errorf("%s: env %s: %v", manifestFile, m.Name, err)
+	}
+	req.Stack = components
+	return req, nil
+}
+
+// matches reports whether an existing environment was created from the
+// same template and requested versions as req, and has exactly the packages
+// and variables it declares.
+func (req envRequest) matches(meta *envMetadata) bool {
+	if !slices.Equal(req.Packages, meta.Packages) || !maps.Equal(req.Env, meta.Env) {
+		return false
+	}
+	if len(req.Stack) == 0 {
+		return meta.Template == req.Template && len(meta.Components) == 0 && meta.RequestedVersion == req.Version
+	}
+	return slices.EqualFunc(req.Stack, meta.Components, func(a, b envComponent) bool {
+		return a.Template == b.Template && a.RequestedVersion == b.RequestedVersion
+	})
+}
+
+// manifestEntry describes req as a manifest entry, as recorded by
+// `create --save`.
+func manifestEntry(req envRequest) manifestEnv {
+	m := manifestEnv{Name: req.Name, Track: req.Track, Inactive: req.Inactive, Packages: req.Packages, Env: req.Env}
+	if len(req.Stack) > 0 {
+		if m.Name == "" {
+			m.Name = stackTemplate
+		}
+		for _, c := range req.Stack {
+			m.Stack = append(m.Stack, c.Template+" "+c.RequestedVersion)
+		}
+		return m
+	}
+	if m.Name == "" {
+		m.Name = req.Template
+	}
+	m.Template, m.Version = req.Template, req.Version
+	return m
+}
+
+func handleSync(args []string) {
+	_, flags := parseFlags(args)
+	yes := flags.has("--yes")
+	refresh := flags.has("--refresh")
+
+	declared, err := readManifest()
+	if os.IsNotExist(err) {
+		fatal(fmt.Sprintf("No %s found. Declare envs there or use: nix-envs create <template> <version> --save", manifestFile))
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	var requests []envRequest
+	active := make(map[string]string)
+	for _, m := range declared {
+		req, err := m.request()
+		if err != nil {
+			fatal(err.Error())
+		}
+		req.Refresh = refresh
+		if !req.Inactive {
+			for _, template := range requestTemplates(req) {
+				if other, dup := active[template]; dup {
+					fatal(fmt.Sprintf("%s: envs %s and %s both provide %s; set active = false on one of them", manifestFile, other, m.Name, template))
+				}
+				active[template] = m.Name
+			}
+		}
+		requests = append(requests, req)
+	}
+
+	lock, err := readLock()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	project := getProject()
+	existing := make(map[string]projectEnv)
+	for _, env := range loadProjectEnvs(project.ID) {
+		existing[env.Name] = env
+	}
+
+	var failed []string
+	unlocked := make(map[string]*envMetadata)
+	for _, req := range requests {
+		env, ok := existing[req.Name]
+		upToDate := ok && !refresh && req.matches(env.Meta)
+		l := lock.Envs[req.Name]
+		if upToDate && l != nil && l.satisfies(req) {
+			upToDate = l.pins(env.Meta)
+		} else if upToDate {
+			unlocked[req.Name] = env.Meta
+		}
+		if upToDate {
+			if req.Inactive {
+				removeFromEnvrc(env.Dir)
+			} else if !envrcReferences(".", env.Dir) {
+				activateEnv(project.ID, req.Name, env.Meta)
+			}
+			continue
+		}
+
+		if !ok {
+			fmt.Printf("Adding %s...\n", req.Name)
+		} else {
+			fmt.Printf("Updating %s...\n", req.Name)
+			template := req.Template
+			if len(req.Stack) > 0 {
+				template = stackTemplate
+			}
+			if env.Meta.Template != template {
+				if err := deleteEnv(project.ID, req.Name); err != nil {
+					fmt.Printf("%sError: %s%s\n", ColorRed, err.Error(), ColorReset)
+					failed = append(failed, req.Name)
+					continue
+				}
+			}
+		}
+		if err := createEnv(req); err != nil {
+			fmt.Printf("%sError: %s%s\n", ColorRed, err.Error(), ColorReset)
+			failed = append(failed, req.Name)
+			continue
+		}
+		if req.Inactive {
+			removeFromEnvrc(getCacheDir(project.ID, req.Name))
+		}
+	}
+
+	// createEnv has locked the envs it created; pin the ones that were already
+	// up to date and drop envs that are no longer declared.
+	if lock, err := readLock(); err == nil {
+		changed := len(unlocked) > 0
+		for name, meta := range unlocked {
+			lock.Envs[name] = lockEntry(meta)
+		}
+		for name := range lock.Envs {
+			if !slices.ContainsFunc(requests, func(r envRequest) bool { return r.Name == name }) {
+				delete(lock.Envs, name)
+				changed = true
+			}
+		}
+		if changed {
+			if err := writeLock(lock); err != nil {
+				fatal(fmt.Sprintf("Failed to write %s: %v", lockFile, err))
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(existing) {
+		if slices.ContainsFunc(requests, func(r envRequest) bool { return r.Name == name }) {
+			continue
+		}
+		if !yes && !confirm(fmt.Sprintf("%s is not declared in %s. Delete it?", name, manifestFile)) {
+			continue
+		}
+		if err := deleteEnv(project.ID, name); err != nil {
+			fmt.Printf("%sError: %s%s\n", ColorRed, err.Error(), ColorReset)
+			failed = append(failed, name)
+			continue
+		}
+		fmt.Printf("%sDeleted %s environment.%s\n", ColorYellow, name, ColorReset)
+	}
+
+	if len(failed) > 0 {
+		fatal("Failed to sync: " + strings.Join(failed, ", "))
+	}
+	fmt.Printf("%sEnvironments match %s.%s\n", ColorGreen, manifestFile, ColorReset)
+}
+
+// requestTemplates lists the templates an env created from req provides.
+func requestTemplates(req envRequest) []string {
+	if len(req.Stack) == 0 {
+		return []string{req.Template}
+	}
+	var templates []string
+	for _, c := range req.Stack {
+		templates = append(templates, c.Template)
+	}
+	return templates
+}
+
+// saveManifestEnv writes m as the [envs.<name>] table of the manifest,
+// updating the keys nix-envs manages and leaving everything else in the file
+// untouched.
+func saveManifestEnv(m manifestEnv) error {
+	content, _ := os.ReadFile(manifestFile)
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		lines = nil
+	}
+
+	values := map[string]string{}
+	var keys []string
+	set := func(key, value string) {
+		keys = append(keys, key)
+		values[key] = value
+	}
+	if m.Stack != nil {
+		set("template", "")
+		set("version", "")
+		set("stack", tomlStrings(m.Stack))
+	} else {
+		template := ""
+		if m.Template != m.Name {
+			template = fmt.Sprintf("%q", m.Template)
+		}
+		set("template", template)
+		set("version", fmt.Sprintf("%q", m.Version))
+		set("stack", "")
+	}
+	set("packages", tomlStrings(m.Packages))
+	set("env", tomlInlineTable(m.Env))
+	set("track", map[bool]string{true: "true"}[m.Track])
+	set("active", map[bool]string{true: "false"}[m.Inactive])
+
+	header := "[envs." + m.Name + "]"
+	start, end := -1, len(lines)
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if start < 0 && (trimmed == header || trimmed == `[envs."`+m.Name+`"]`) {
+			start = i
+		} else if start >= 0 && strings.HasPrefix(trimmed, "[") {
+			end = i
+			break
+		}
+	}
+	if start < 0 {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, header)
+		start, end = len(lines)-1, len(lines)
+	}
+
+	written := make(map[string]bool)
+	var table []string
+	for _, line := range lines[start+1 : end] {
+		key, _, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if v, managed := values[key]; ok && managed {
+			written[key] = true
+			if v == "" {
+				continue
+			}
+			line = key + " = " + v
+		}
+		table = append(table, line)
+	}
+
+	// New keys go after the last non-blank line of the table.
+	insertAt := len(table)
+	for insertAt > 0 && strings.TrimSpace(table[insertAt-1]) == "" {
+		insertAt--
+	}
+	var added []string
+	for _, key := range keys {
+		if !written[key] && values[key] != "" {
+			added = append(added, key+" = "+values[key])
+		}
+	}
+	table = append(table[:insertAt], append(added, table[insertAt:]...)...)
+
+	lines = append(lines[:start+1], append(table, lines[end:]...)...)
+	return os.WriteFile(manifestFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// tomlStrings renders a TOML array of strings, or "" for an empty one so the
+// key is left out.
+func tomlStrings(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	quoted := make([]string, len(values))
+	for i, s := range values {
+		quoted[i] = fmt.Sprintf("%q", s)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// tomlInlineTable renders string values as a TOML inline table, or "" for an
+// empty map so the key is left out.
+func tomlInlineTable(values map[string]string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	var pairs []string
+	for _, key := range sortedKeys(values) {
+		pairs = append(pairs, fmt.Sprintf("%s = %q", key, values[key]))
+	}
+	return "{ " + strings.Join(pairs, ", ") + " }"
+}
+
+// saveManifestExtras records the packages and variables added to env name in
+// the manifest, if the manifest declares it, so sync recreates them on other
+// machines.
+func saveManifestExtras(name string, meta *envMetadata) error {
+	declared, err := readManifest()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	i := slices.IndexFunc(declared, func(m manifestEnv) bool { return m.Name == name })
+	if i < 0 {
+		return nil
+	}
+	m := declared[i]
+	m.Packages, m.Env = meta.Packages, meta.Env
+	if err := saveManifestEnv(m); err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s\n", manifestFile)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+const (
+	appVersion   = "0.1.0"
+	metadataFile = "metadata.json"
+)
+
+// source is an upstream artifact a generated flake fetches.
+type source struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// envMetadata is persisted next to each generated flake.nix so later commands
+// know how an environment was produced and which project owns it.
+type envMetadata struct {
+	Template         string            `json:"template"`
+	RequestedVersion string            `json:"requested_version,omitempty"`
+	Version          string            `json:"version"`
+	Arch             string            `json:"arch"`
+	Sources          map[string]source `json:"sources,omitempty"`
+	// Components lists the templates composed into a stacked environment,
+	// in stack order. Template is "stack" and Version is unused for stacks.
+	Components []envComponent `json:"components,omitempty"`
+	// Nixpkgs is the nixpkgs revision the flake was generated against. It
+	// holds a branch name when the revision could not be looked up, and is
+	// empty for envs that follow nixos-unstable.
+	Nixpkgs string `json:"nixpkgs,omitempty"`
+	// Packages are nixpkgs packages added with --with or add, by attribute
+	// path, on top of the template's own.
+	Packages []string `json:"packages,omitempty"`
+	// Env holds variables set with `env set`, rendered into the shell's env
+	// over the template's own.
+	Env            map[string]string `json:"env,omitempty"`
+	NixEnvsVersion string            `json:"nix_envs_version"`
+	ProjectRoot    string            `json:"project_root"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+func readMetadata(cacheDir string) (*envMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(cacheDir, metadataFile))
+	if err != nil {
+		return nil, err
+	}
+	var meta struct {
+		envMetadata
+		// Single-system fields written before flakes covered every system.
+		URL    string `json:"url"`
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid %s in %s: %v", metadataFile, cacheDir, err)
+	}
+	if meta.Sources == nil && meta.URL != "" {
+		meta.Sources = map[string]source{meta.Arch: {URL: meta.URL, SHA256: meta.SHA256}}
+	}
+	return &meta.envMetadata, nil
+}
+
+// templates returns the templates an environment provides: its components
+// for a stack, otherwise its own template.
+func (m *envMetadata) templates() []string {
+	if len(m.Components) == 0 {
+		return []string{m.Template}
+	}
+	var templates []string
+	for _, c := range m.Components {
+		templates = append(templates, c.Template)
+	}
+	return templates
+}
+
+// projectEnv is an environment found in a project's cache directory.
+type projectEnv struct {
+	Name string
+	Dir  string
+	Meta *envMetadata
+}
+
+// loadProjectEnvs returns every environment stored for project, sorted by
+// name. Envs created before metadata.json existed get metadata reconstructed
+// from their flake, with an empty ProjectRoot.
+func loadProjectEnvs(project string) []projectEnv {
+	dirs, err := os.ReadDir(filepath.Join(getCacheRoot(), project))
+	if err != nil {
+		return nil
+	}
+
+	var envs []projectEnv
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		cacheDir := getCacheDir(project, d.Name())
+		flakePath := filepath.Join(cacheDir, "flake.nix")
+		info, err := os.Stat(flakePath)
+		if err != nil {
+			continue
+		}
+
+		meta, err := readMetadata(cacheDir)
+		if err != nil {
+			meta = &envMetadata{
+				Template:  d.Name(),
+				Version:   flakeVersion(flakePath),
+				CreatedAt: info.ModTime(),
+				UpdatedAt: info.ModTime(),
+			}
+		}
+		envs = append(envs, projectEnv{Name: d.Name(), Dir: cacheDir, Meta: meta})
+	}
+	return envs
+}
+
+// writeMetadata stores meta in cacheDir, keeping the creation time of any
+// metadata already present.
+func writeMetadata(cacheDir string, meta *envMetadata) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	if existing, err := readMetadata(cacheDir); err == nil && !existing.CreatedAt.IsZero() {
+		meta.CreatedAt = existing.CreatedAt
+	}
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = now
+	}
+	meta.UpdatedAt = now
+	meta.NixEnvsVersion = appVersion
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cacheDir, metadataFile), append(data, '\n'), 0644)
+}
+
+// hostSystem returns the Nix system double for the running machine.
+func hostSystem() string {
+	arch := runtime.GOARCH
+	switch arch {
+	case "amd64":
+		arch = "x86_64"
+	case "arm64":
+		arch = "aarch64"
+	}
+	return arch + "-" + runtime.GOOS
+}
+
+func getProjectRoot() string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	return wd
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var nixpkgsRevPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// resolveNixpkgs looks up the commit a nixpkgs branch or tag points to.
+// Full commit hashes are returned as is.
+func resolveNixpkgs(ref string) (string, error) {
+	if nixpkgsRevPattern.MatchString(ref) {
+		return ref, nil
+	}
+	var commit struct {
+		SHA string `json:"sha"`
+	}
+	url := "https://api.github.com/repos/NixOS/nixpkgs/commits/" + ref
+	if err := fetchJSON(url, &commit); err != nil {
+		return "", err
+	}
+	if commit.SHA == "" {
+		return "", fmt.Errorf("no commit found for nixpkgs %s", ref)
+	}
+	return commit.SHA, nil
+}
+
+// nixpkgsRevision picks the nixpkgs revision for a new env: ref if given,
+// else the configured default, else the head of nixpkgsBranch. An explicit
+// ref must resolve. When the default cannot be looked up the flake follows
+// the branch instead, unless pinned is set because the revision is about to
+// be recorded as a pin, e.g. in the lockfile.
+func nixpkgsRevision(ref string, pinned bool) (string, error) {
+	if ref != "" {
+		rev, err := resolveNixpkgs(ref)
+		if err != nil {
+			return "", fmt.Errorf("Could not resolve nixpkgs %s: %v", ref, err)
+		}
+		return rev, nil
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+	ref = cfg.Nixpkgs
+	if ref == "" {
+		ref = nixpkgsBranch
+	}
+	rev, err := resolveNixpkgs(ref)
+	if err != nil && pinned {
+		return "", fmt.Errorf("Could not pin nixpkgs %s: %v", ref, err)
+	}
+	if err != nil {
+		fmt.Printf("%sWarning: could not pin nixpkgs, following %s: %v%s\n", ColorYellow, ref, err, ColorReset)
+		return ref, nil
+	}
+	return rev, nil
+}
+
+func handlePin(args []string) {
+	positional, _ := parseFlags(args)
+	ref := ""
+	if len(positional) > 0 {
+		ref = positional[0]
+	}
+	rev, err := nixpkgsRevision(ref, true)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	envs := loadProjectEnvs(getProject().ID)
+	if len(envs) == 0 {
+		fatal("No environments found for this project.")
+	}
+
+	var failed []string
+	for _, env := range envs {
+		if _, err := readMetadata(env.Dir); err != nil {
+			fmt.Printf("%sSkipping %s: it has no metadata.json; recreate it first.%s\n", ColorYellow, env.Name, ColorReset)
+			continue
+		}
+		meta := env.Meta
+		if len(meta.Components) == 0 {
+			// A plugin's complete flake brings its own nixpkgs input.
+			if spec, err := envSpec(meta); err == nil && spec.Flake != "" {
+				fmt.Printf("%sSkipping %s: %s provides a complete flake, which sets its own nixpkgs.%s\n", ColorYellow, env.Name, meta.Template, ColorReset)
+				continue
+			}
+		}
+		if meta.Nixpkgs == rev {
+			fmt.Printf("%s is already pinned to %s\n", env.Name, rev)
+			continue
+		}
+		meta.Nixpkgs = rev
+		recordHistory(env.Dir)
+		content, err := renderEnv(meta)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(env.Dir, "flake.nix"), []byte(content), 0644)
+		}
+		if err == nil {
+			err = writeMetadata(env.Dir, meta)
+		}
+		if err == nil {
+			lockFlake(env.Dir)
+			recordHistory(env.Dir)
+		}
+		if err == nil {
+			err = updateLock(env.Name, meta)
+		}
+		if err != nil {
+			fmt.Printf("%sError: %s: %s%s\n", ColorRed, env.Name, err.Error(), ColorReset)
+			failed = append(failed, env.Name)
+			continue
+		}
+		fmt.Printf("Pinned %s to nixpkgs %s\n", env.Name, rev)
+	}
+	if len(failed) > 0 {
+		fatal("Failed to pin: " + strings.Join(failed, ", "))
+	}
+}
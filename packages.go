@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var packageAttrPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_'-]*(\.[A-Za-z_][A-Za-z0-9_'-]*)*$`)
+
+// packageAttr validates a nixpkgs package given on the command line and
+// returns its attribute path, accepting "postgresql" and "pkgs.postgresql"
+// alike.
+func packageAttr(pkg string) (string, error) {
+	attr := strings.TrimPrefix(pkg, "pkgs.")
+	if !packageAttrPattern.MatchString(attr) {
+		return "", fmt.Errorf("Invalid package %q: expected a nixpkgs attribute such as postgresql or nodePackages.pnpm", pkg)
+	}
+	return attr, nil
+}
+
+// extraSpec describes what was added to an env on top of its templates, or
+// nil if nothing was.
+func (m *envMetadata) extraSpec() *shellSpec {
+	if len(m.Packages) == 0 && len(m.Env) == 0 {
+		return nil
+	}
+	spec := &shellSpec{}
+	for _, pkg := range m.Packages {
+		spec.Packages = append(spec.Packages, "pkgs."+pkg)
+	}
+	for _, key := range sortedKeys(m.Env) {
+		spec.Env = append(spec.Env, envVar{key, nixLiteral(m.Env[key])})
+	}
+	return spec
+}
+
+func handleAdd(args []string) {
+	editPackages("add", args)
+}
+
+func handleRemove(args []string) {
+	editPackages("remove", args)
+}
+
+// editPackages adds packages to or removes them from an env's shell, records
+// them in its metadata and regenerates its flake.
+func editPackages(command string, args []string) {
+	positional, flags := parseFlags(args)
+	if len(positional) < 2 {
+		fatal(fmt.Sprintf("Usage: nix-envs %s <env> <package>... [--yes] [--force]", command))
+	}
+	name := positional[0]
+	cacheDir := getCacheDir(getProject().ID, name)
+	meta, err := readMetadata(cacheDir)
+	if err != nil {
+		fatal("Environment not found, or it has no metadata.json; recreate it first.")
+	}
+
+	next := *meta
+	next.Packages = slices.Clone(meta.Packages)
+	for _, pkg := range positional[1:] {
+		attr, err := packageAttr(pkg)
+		if err != nil {
+			fatal(err.Error())
+		}
+		i := slices.Index(next.Packages, attr)
+		switch {
+		case command == "add" && i >= 0:
+			fmt.Printf("%s already has %s\n", name, attr)
+		case command == "add":
+			next.Packages = append(next.Packages, attr)
+		case i < 0:
+			fatal(fmt.Sprintf("%s was not added to %s; only packages added with --with or add can be removed.", attr, name))
+		default:
+			next.Packages = slices.Delete(next.Packages, i, i+1)
+		}
+	}
+	if slices.Equal(next.Packages, meta.Packages) {
+		return
+	}
+
+	if !regenerateEnv(cacheDir, meta, &next, flags) {
+		return
+	}
+	if err := saveManifestExtras(name, &next); err != nil {
+		fatal(fmt.Sprintf("Failed to write %s: %v", manifestFile, err))
+	}
+	fmt.Printf("%sUpdated %s: %s%s\n", ColorGreen, name, packageSummary(next.Packages), ColorReset)
+}
+
+// regenerateEnv renders the flake for an env's metadata, changed from old,
+// shows the diff and, once confirmed, writes both. A flake.nix that differs
+// from what old generates was edited by hand, and is only overwritten with
+// --force. It returns false if the user declined.
+func regenerateEnv(cacheDir string, old, meta *envMetadata, flags flagSet) bool {
+	oldFlake, _ := os.ReadFile(filepath.Join(cacheDir, "flake.nix"))
+	generated, err := renderEnv(old)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if generated != string(oldFlake) && !flags.has("--force") {
+		fatal("flake.nix differs from what nix-envs generates for it (edited with nix-envs edit, or by an older version), and regenerating it would drop those changes.\n" +
+			"Make the change with nix-envs edit instead, or rerun with --force to regenerate it; nix-envs rollback restores the old flake.")
+	}
+
+	flakeContent, err := renderEnv(meta)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if !applyFlake(cacheDir, string(oldFlake), flakeContent, flags.has("--yes")) {
+		return false
+	}
+	if err := writeMetadata(cacheDir, meta); err != nil {
+		fatal("Failed to write metadata.json: " + err.Error())
+	}
+	recordHistory(cacheDir)
+	return true
+}
+
+// packageSummary lists the packages added to an env for display.
+func packageSummary(packages []string) string {
+	if len(packages) == 0 {
+		return "no extra packages"
+	}
+	return "with " + strings.Join(packages, ", ")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// pluginPrefix names the executables on PATH that provide templates, like
+// git's subcommands: nix-envs-template-foo provides the template foo.
+const pluginPrefix = "nix-envs-template-"
+
+const pluginProtocol = 1
+
+// pluginTemplate is a template provided by an external executable. Each
+// Template method runs the plugin once, writing a pluginRequest as JSON to its
+// stdin and reading a pluginResponse from its stdout. The plugin's stderr is
+// passed through so it can report progress. Plugins answer commands they do
+// not implement with {}.
+type pluginTemplate struct {
+	name string
+	path string
+}
+
+// pluginRequest is sent to a plugin on stdin. Command is one of describe,
+// releases, resolve, fetch or render.
+type pluginRequest struct {
+	Protocol int               `json:"protocol"`
+	Command  string            `json:"command"`
+	Template string            `json:"template"`
+	System   string            `json:"system"`
+	Systems  []string          `json:"systems"`
+	Version  string            `json:"version,omitempty"`
+	Sources  map[string]source `json:"sources,omitempty"`
+	// Src is a fetchurl expression for Sources, for render.
+	Src string `json:"src,omitempty"`
+}
+
+// pluginResponse is read from a plugin's stdout. Only the fields of the
+// command asked for are looked at.
+type pluginResponse struct {
+	Error string `json:"error"`
+	// describe: a one-line summary; render: the flake's description
+	Description string `json:"description"`
+	// releases
+	Releases []struct {
+		Version    string   `json:"version"`
+		Prerelease bool     `json:"prerelease"`
+		LTS        string   `json:"lts"`
+		EOL        bool     `json:"eol"`
+		Systems    []string `json:"systems"`
+	} `json:"releases"`
+	// resolve
+	Version string `json:"version"`
+	// fetch
+	Sources map[string]source `json:"sources"`
+	// render: either a complete flake.nix, or a devShell for nix-envs to
+	// write the flake around
+	Flake     string            `json:"flake"`
+	Inputs    []pluginInput     `json:"inputs"`
+	Overlays  []string          `json:"overlays"`
+	Bindings  string            `json:"bindings"`
+	Packages  []string          `json:"packages"`
+	Env       map[string]string `json:"env"`
+	ShellHook string            `json:"shell_hook"`
+	Systems   []string          `json:"systems"`
+}
+
+type pluginInput struct {
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	FollowsNixpkgs bool   `json:"follows_nixpkgs"`
+}
+
+// lookupPlugin finds the plugin providing the template called name on PATH.
+// The error satisfies os.IsNotExist when there is none.
+func lookupPlugin(name string) (*pluginTemplate, error) {
+	if !envNamePattern.MatchString(name) {
+		return nil, os.ErrNotExist
+	}
+	path, err := exec.LookPath(pluginPrefix + name)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return &pluginTemplate{name: name, path: path}, nil
+}
+
+// listPlugins returns the plugins on PATH, the first of each name winning as
+// it does for lookups.
+func listPlugins() []*pluginTemplate {
+	var names []string
+	var plugins []*pluginTemplate
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name, ok := strings.CutPrefix(e.Name(), pluginPrefix)
+			if !ok || contains(names, name) {
+				continue
+			}
+			if p, err := lookupPlugin(name); err == nil {
+				names = append(names, name)
+				plugins = append(plugins, p)
+			}
+		}
+	}
+	return plugins
+}
+
+// call runs the plugin for one command.
+func (t *pluginTemplate) call(req pluginRequest) (*pluginResponse, error) {
+	req.Protocol = pluginProtocol
+	req.Template = t.name
+	req.System = hostSystem()
+	req.Systems = flakeSystems
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(t.path)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("plugin %s failed to %s: %v", t.path, req.Command, err)
+	}
+
+	var resp pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("plugin %s: invalid response to %s: %v", t.path, req.Command, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s: %s", t.name, resp.Error)
+	}
+	return &resp, nil
+}
+
+func (t *pluginTemplate) Name() string { return t.name }
+
+func (t *pluginTemplate) Description() string {
+	resp, err := t.call(pluginRequest{Command: "describe"})
+	if err != nil || resp.Description == "" {
+		return "Plugin " + t.path
+	}
+	return resp.Description
+}
+
+func (t *pluginTemplate) Releases() ([]release, error) {
+	resp, err := t.call(pluginRequest{Command: "releases"})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Releases) == 0 {
+		return nil, fmt.Errorf("plugin %s does not list releases", t.name)
+	}
+	var releases []release
+	for _, r := range resp.Releases {
+		releases = append(releases, release{
+			Version:    r.Version,
+			Prerelease: r.Prerelease,
+			LTS:        r.LTS,
+			EOL:        r.EOL,
+			Systems:    r.Systems,
+		})
+	}
+	return releases, nil
+}
+
+// Resolve asks the plugin for the version to build. Plugins that don't
+// resolve versions get them as given.
+func (t *pluginTemplate) Resolve(requested string) (string, error) {
+	resp, err := t.call(pluginRequest{Command: "resolve", Version: requested})
+	if err != nil {
+		return "", err
+	}
+	if resp.Version == "" {
+		return requested, nil
+	}
+	return resp.Version, nil
+}
+
+func (t *pluginTemplate) Fetch(version string) (map[string]source, error) {
+	resp, err := t.call(pluginRequest{Command: "fetch", Version: version})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Sources) == 0 {
+		return nil, nil
+	}
+	if err := requireHostSource(resp.Sources, version); err != nil {
+		return nil, err
+	}
+	return resp.Sources, nil
+}
+
+func (t *pluginTemplate) Render(version string, sources map[string]source) (*shellSpec, error) {
+	req := pluginRequest{Command: "render", Version: version, Sources: sources}
+	if len(sources) > 0 {
+		src, err := nixFetchurl(sources)
+		if err != nil {
+			return nil, err
+		}
+		req.Src = src
+	}
+	resp, err := t.call(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Flake != "" {
+		return &shellSpec{Description: resp.Description, Flake: resp.Flake}, nil
+	}
+
+	spec := &shellSpec{
+		Description: resp.Description,
+		Overlays:    resp.Overlays,
+		Packages:    resp.Packages,
+		ShellHook:   resp.ShellHook,
+		Systems:     resp.Systems,
+	}
+	if spec.Description == "" {
+		spec.Description = fmt.Sprintf("%s %s Environment", t.name, version)
+	}
+	if resp.Bindings != "" {
+		spec.Bindings = indentNix(strings.TrimSpace(resp.Bindings), "      ")
+	}
+	for _, in := range resp.Inputs {
+		spec.Inputs = append(spec.Inputs, flakeInput{Name: in.Name, URL: in.URL, FollowsNixpkgs: in.FollowsNixpkgs})
+	}
+	for _, key := range sortedKeys(resp.Env) {
+		spec.Env = append(spec.Env, envVar{key, nixString(resp.Env[key])})
+	}
+	if spec.Systems == nil && len(sources) > 0 {
+		spec.Systems = sourceSystems(sources)
+	}
+	return spec, nil
+}
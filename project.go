@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// project identifies where a project's environments live in the cache.
+type project struct {
+	// ID is the cache directory name: the alias plus a short hash of Root,
+	// so two checkouts that share a basename never share environments.
+	ID string
+	// Alias is the human-readable basename of the project.
+	Alias string
+	// Root is the absolute path of the main worktree, or of the working
+	// directory outside git.
+	Root string
+}
+
+// getProject resolves the current project. Git worktrees resolve to their
+// main worktree so they share environments.
+func getProject() project {
+	var root, alias string
+
+	cmd := exec.Command("git", "rev-parse", "--git-common-dir")
+	output, err := cmd.Output()
+	if err == nil {
+		path := strings.TrimSpace(string(output))
+		absPath, _ := filepath.Abs(path)
+
+		base := filepath.Base(absPath)
+		if base == ".git" {
+			root = filepath.Dir(absPath)
+			alias = filepath.Base(root)
+		} else {
+			root = absPath
+			alias = strings.TrimSuffix(base, ".git")
+		}
+	} else {
+		root, _ = os.Getwd()
+		alias = filepath.Base(root)
+	}
+
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	sum := sha256.Sum256([]byte(root))
+	return project{
+		ID:    alias + "-" + hex.EncodeToString(sum[:])[:8],
+		Alias: alias,
+		Root:  root,
+	}
+}
+
+// migrateLegacyProject moves environments from the basename-keyed cache
+// layout (~/.cache/envs/<alias>/) to the project's ID. Only environments that
+// provably belong to this project move: their metadata names a directory
+// inside the project root, or, lacking metadata, the local .envrc uses them.
+func migrateLegacyProject(p project) {
+	legacyDir := filepath.Join(getCacheRoot(), p.Alias)
+	if _, err := os.Stat(legacyDir); err != nil {
+		return
+	}
+
+	for _, env := range loadProjectEnvs(p.Alias) {
+		owner := env.Meta.ProjectRoot
+		if owner == "" {
+			if !envrcReferences(".", env.Dir) {
+				continue
+			}
+			owner = "."
+		} else if owner != p.Root && !strings.HasPrefix(owner, p.Root+string(filepath.Separator)) {
+			continue
+		}
+
+		newDir := getCacheDir(p.ID, env.Name)
+		if _, err := os.Stat(newDir); err == nil {
+			fmt.Printf("%sWarning: not migrating %s, %s already exists.%s\n", ColorYellow, env.Dir, newDir, ColorReset)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(newDir), 0755); err != nil {
+			fmt.Printf("%sWarning: could not migrate %s: %v%s\n", ColorYellow, env.Dir, err, ColorReset)
+			return
+		}
+		if err := os.Rename(env.Dir, newDir); err != nil {
+			fmt.Printf("%sWarning: could not migrate %s: %v%s\n", ColorYellow, env.Dir, err, ColorReset)
+			continue
+		}
+		replaceInEnvrc(owner, env.Dir, newDir)
+		fmt.Printf("Migrated %s environment to %s\n", env.Name, newDir)
+	}
+
+	// Leaves the legacy directory in place if other projects still use it.
+	os.Remove(legacyDir)
+}
+
+// replaceInEnvrc repoints the .envrc in dir from one cache directory to
+// another, re-allowing it if anything changed.
+func replaceInEnvrc(dir, oldDir, newDir string) {
+	path := filepath.Join(dir, ".envrc")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	updated := strings.ReplaceAll(string(content), envrcLine(oldDir), envrcLine(newDir))
+	if updated == string(content) {
+		return
+	}
+	if err := os.WriteFile(path, []byte(updated), 0644); err != nil {
+		return
+	}
+	allowEnvrc(dir)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// pruneCandidate is a cache entry prune would remove, and why.
+type pruneCandidate struct {
+	Project string
+	Name    string
+	Dir     string
+	Root    string
+	Reason  string
+	Size    int64
+	// Trashed is set for envs already deleted and waiting in the trash.
+	Trashed bool
+}
+
+func handlePrune(args []string) {
+	_, flags := parseFlags(args, "--older-than")
+	// Without --older-than, inactive instances are kept however old.
+	var cutoff time.Time
+	if v := flags.value("--older-than"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			fatal("--older-than takes a number of days")
+		}
+		cutoff = time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	}
+
+	candidates := findPruneCandidates(cutoff)
+	if len(candidates) == 0 {
+		fmt.Println("Nothing to prune.")
+		return
+	}
+
+	var total int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tNAME\tSIZE\tREASON")
+	for _, c := range candidates {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Project, c.Name, formatSize(c.Size), c.Reason)
+		total += c.Size
+	}
+	w.Flush()
+
+	if !flags.has("--yes") && !confirm(fmt.Sprintf("Delete these %d environments (%s)?", len(candidates), formatSize(total))) {
+		fmt.Println("Aborted.")
+		return
+	}
+
+	var failed []string
+	for _, c := range candidates {
+		if err := os.RemoveAll(c.Dir); err != nil {
+			fmt.Printf("%sError: %s/%s: %v%s\n", ColorRed, c.Project, c.Name, err, ColorReset)
+			failed = append(failed, c.Project+"/"+c.Name)
+			continue
+		}
+		if !c.Trashed && c.Root != "" {
+			removeFromProjectEnvrc(c.Root, c.Dir)
+		}
+		// History goes once neither the env nor a deleted copy is left.
+		cacheDir := getCacheDir(c.Project, c.Name)
+		if _, err := os.Stat(cacheDir); os.IsNotExist(err) && len(listEntries(bookkeepingDir(trashDirName, cacheDir))) == 0 {
+			os.RemoveAll(bookkeepingDir(historyDirName, cacheDir))
+		}
+		for _, kind := range []string{historyDirName, trashDirName} {
+			removeEmptyDirs(filepath.Join(getCacheRoot(), kind, c.Project, c.Name), getCacheRoot())
+		}
+		removeEmptyDirs(filepath.Join(getCacheRoot(), c.Project), getCacheRoot())
+	}
+	fmt.Printf("%sPruned %d environments, freeing %s.%s\n", ColorGreen, len(candidates)-len(failed), formatSize(total), ColorReset)
+
+	if flags.has("--gc-roots") {
+		removeGCRoots(candidates)
+	} else {
+		fmt.Println("Pass --gc-roots to also remove direnv's profiles, so nix-collect-garbage can reclaim their store paths.")
+	}
+	if len(failed) > 0 {
+		fatal("Failed to prune: " + strings.Join(failed, ", "))
+	}
+}
+
+// findPruneCandidates looks through every project in the cache for envs whose
+// project directory is gone, envs nothing in their project uses, inactive
+// instances unchanged since cutoff and envs deleted longer ago than the
+// configured history_days.
+func findPruneCandidates(cutoff time.Time) []pruneCandidate {
+	root := getCacheRoot()
+	dirs, err := os.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		fatal("Failed to read cache directory: " + err.Error())
+	}
+
+	var candidates []pruneCandidate
+	for _, d := range dirs {
+		if !d.IsDir() || isCacheBookkeeping(d.Name()) {
+			continue
+		}
+		project := d.Name()
+		envs := loadProjectEnvs(project)
+		for _, env := range envs {
+			c := pruneCandidate{Project: project, Name: env.Name, Dir: env.Dir, Root: env.Meta.ProjectRoot}
+			if c.Reason = pruneReason(env, envs, cutoff); c.Reason == "" {
+				continue
+			}
+			c.Size = dirSize(env.Dir) + dirSize(bookkeepingDir(historyDirName, env.Dir))
+			candidates = append(candidates, c)
+		}
+	}
+
+	// Recently deleted envs stay restorable for as long as history is kept.
+	cfg, err := loadConfig()
+	if err != nil {
+		cfg = &config{HistoryDays: defaultHistoryDays}
+	}
+	trashCutoff := time.Now().Add(-time.Duration(cfg.HistoryDays) * 24 * time.Hour)
+	projects, _ := os.ReadDir(filepath.Join(root, trashDirName))
+	for _, p := range projects {
+		names, _ := os.ReadDir(filepath.Join(root, trashDirName, p.Name()))
+		for _, n := range names {
+			for _, e := range listEntries(filepath.Join(root, trashDirName, p.Name(), n.Name())) {
+				if e.SavedAt.After(trashCutoff) {
+					continue
+				}
+				candidates = append(candidates, pruneCandidate{
+					Project: p.Name(),
+					Name:    n.Name(),
+					Dir:     e.Dir,
+					Reason:  "deleted " + e.SavedAt.Local().Format("2006-01-02"),
+					Size:    dirSize(e.Dir),
+					Trashed: true,
+				})
+			}
+		}
+	}
+	return candidates
+}
+
+// pruneReason says why env, one of the envs of its project, should be pruned,
+// or returns "" to keep it. Envs in .envrc or the manifest are in use. An env
+// left out of .envrc while another instance of its template is active is one
+// of the versions kept side by side with --name, and only pruned once unchanged
+// since cutoff. Envs without a recorded project directory predate
+// metadata.json and are kept, since nothing says where they are used.
+func pruneReason(env projectEnv, envs []projectEnv, cutoff time.Time) string {
+	root := env.Meta.ProjectRoot
+	if root == "" {
+		return ""
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return "project directory " + root + " is gone"
+	}
+	if envrcReferences(root, env.Dir) || manifestDeclares(root, env.Name) {
+		return ""
+	}
+	if !hasActiveSibling(env, envs) {
+		return "not in " + filepath.Join(root, ".envrc")
+	}
+	if last := lastChanged(env); last.Before(cutoff) {
+		return "inactive, unchanged since " + last.Local().Format("2006-01-02")
+	}
+	return ""
+}
+
+// hasActiveSibling reports whether the .envrc of env's project activates
+// another env providing one of its templates.
+func hasActiveSibling(env projectEnv, envs []projectEnv) bool {
+	templates := env.Meta.templates()
+	for _, other := range envs {
+		if other.Name == env.Name || !envrcReferences(env.Meta.ProjectRoot, other.Dir) {
+			continue
+		}
+		if slices.ContainsFunc(other.Meta.templates(), func(t string) bool { return contains(templates, t) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastChanged is when env's flake or lock was last written.
+func lastChanged(env projectEnv) time.Time {
+	last := env.Meta.UpdatedAt
+	for _, file := range []string{"flake.nix", "flake.lock"} {
+		if info, err := os.Stat(filepath.Join(env.Dir, file)); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+// manifestDeclares reports whether the manifest in projectRoot declares env
+// name, which keeps envs marked active = false from being pruned.
+func manifestDeclares(projectRoot, name string) bool {
+	data, err := os.ReadFile(filepath.Join(projectRoot, manifestFile))
+	if err != nil {
+		return false
+	}
+	doc, err := parseTOML(string(data))
+	if err != nil {
+		return false
+	}
+	_, ok := doc["envs."+name]
+	return ok
+}
+
+// removeGCRoots removes the profiles nix-direnv keeps in .direnv/ of projects
+// that no longer have any env, so nix-collect-garbage can reclaim the store
+// paths they pin. Projects whose directory is gone left only dangling roots,
+// which nix drops by itself.
+func removeGCRoots(pruned []pruneCandidate) {
+	projects := make(map[string]string)
+	for _, c := range pruned {
+		if c.Root != "" {
+			projects[c.Root] = c.Project
+		}
+	}
+	removed := 0
+	for _, root := range sortedKeys(projects) {
+		if len(loadProjectEnvs(projects[root])) > 0 {
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(root, ".direnv", "flake-*"))
+		for _, m := range matches {
+			if err := os.RemoveAll(m); err == nil {
+				removed++
+			}
+		}
+	}
+	fmt.Printf("Removed %d GC roots. Run nix-collect-garbage to reclaim the store paths.\n", removed)
+}
+
+// removeEmptyDirs removes dir and its parents up to stop while they are empty.
+func removeEmptyDirs(dir, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// dirSize sums the sizes of the files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && !d.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
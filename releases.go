@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// release is a single upstream version of a template's toolchain.
+type release struct {
+	Version    string   `json:"version"`
+	Prerelease bool     `json:"prerelease"`
+	LTS        string   `json:"lts,omitempty"` // Node.js LTS codename
+	EOL        bool     `json:"eol"`
+	Systems    []string `json:"-"` // Nix systems with binaries; nil means all
+}
+
+// nodePlatforms maps entries of the "files" list in nodejs.org's index.json to
+// Nix systems.
+var nodePlatforms = map[string]string{
+	"linux-x64":     "x86_64-linux",
+	"linux-arm64":   "aarch64-linux",
+	"osx-x64-tar":   "x86_64-darwin",
+	"osx-arm64-tar": "aarch64-darwin",
+}
+
+// goPlatforms maps GOOS/GOARCH pairs from go.dev's download index to Nix
+// systems.
+var goPlatforms = map[string]string{
+	"linux/amd64":  "x86_64-linux",
+	"linux/arm64":  "aarch64-linux",
+	"darwin/amd64": "x86_64-darwin",
+	"darwin/arm64": "aarch64-darwin",
+}
+
+var (
+	luaTarballPattern = regexp.MustCompile(`lua-(\d+\.\d+\.\d+)\.tar\.gz`)
+	prereleasePattern = regexp.MustCompile(`(?i)(alpha|beta|rc|canary|a\d|b\d)`)
+)
+
+// fetchReleases queries the upstream release index of a template, newest
+// version first.
+func fetchReleases(template string) ([]release, error) {
+	t, err := lookupTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	return sortedReleases(t)
+}
+
+// sortedReleases lists the releases of t, newest version first.
+func sortedReleases(t Template) ([]release, error) {
+	releases, err := t.Releases()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(releases, func(i, j int) bool {
+		return compareVersions(releases[i].Version, releases[j].Version) > 0
+	})
+	return releases, nil
+}
+
+// supports reports whether r ships binaries for the given Nix system.
+func (r release) supports(system string) bool {
+	return r.Systems == nil || contains(r.Systems, system)
+}
+
+// latestPatch returns the newest stable release sharing the major.minor of
+// current.
+func latestPatch(template, current string) (string, error) {
+	parts := strings.Split(current, ".")
+	if len(parts) < 2 {
+		return "", fmt.Errorf("cannot determine the minor series of version %q", current)
+	}
+	return resolveVersion(template, parts[0]+"."+parts[1])
+}
+
+// matchesPrefix reports whether version equals prefix or extends it by whole
+// dot-separated components, so "1.2" matches "1.2.3" but not "1.20.0".
+func matchesPrefix(version, prefix string) bool {
+	return version == prefix || strings.HasPrefix(version, prefix+".")
+}
+
+// compareVersions orders dotted versions numerically component by component.
+// A version with a pre-release suffix sorts before the same version without.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xs := splitNumeric(x)
+		yn, ys := splitNumeric(y)
+		if xn != yn {
+			if xn < yn {
+				return -1
+			}
+			return 1
+		}
+		if xs != ys {
+			switch {
+			case xs == "":
+				return 1
+			case ys == "":
+				return -1
+			case xs < ys:
+				return -1
+			default:
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+func splitNumeric(s string) (int, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n, s[i:]
+}
+
+func fetchNodeReleases() ([]release, error) {
+	var index []struct {
+		Version string   `json:"version"`
+		LTS     any      `json:"lts"`
+		Files   []string `json:"files"`
+	}
+	if err := fetchJSON("https://nodejs.org/dist/index.json", &index); err != nil {
+		return nil, err
+	}
+	releases := make([]release, 0, len(index))
+	for _, r := range index {
+		codename, _ := r.LTS.(string)
+		var systems []string
+		for _, f := range r.Files {
+			if system, ok := nodePlatforms[f]; ok {
+				systems = append(systems, system)
+			}
+		}
+		releases = append(releases, release{
+			Version: strings.TrimPrefix(r.Version, "v"),
+			LTS:     codename,
+			Systems: systems,
+		})
+	}
+	return releases, nil
+}
+
+func fetchGoReleases() ([]release, error) {
+	var index []struct {
+		Version string `json:"version"`
+		Stable  bool   `json:"stable"`
+		Files   []struct {
+			OS   string `json:"os"`
+			Arch string `json:"arch"`
+			Kind string `json:"kind"`
+		} `json:"files"`
+	}
+	if err := fetchJSON("https://go.dev/dl/?mode=json&include=all", &index); err != nil {
+		return nil, err
+	}
+	releases := make([]release, 0, len(index))
+	for _, r := range index {
+		systems := []string{}
+		for _, f := range r.Files {
+			if system, ok := goPlatforms[f.OS+"/"+f.Arch]; ok && f.Kind == "archive" {
+				systems = append(systems, system)
+			}
+		}
+		releases = append(releases, release{
+			Version:    strings.TrimPrefix(r.Version, "go"),
+			Prerelease: !r.Stable,
+			Systems:    systems,
+		})
+	}
+	return releases, nil
+}
+
+func fetchPythonReleases() ([]release, error) {
+	var index []struct {
+		Name       string `json:"name"`
+		PreRelease bool   `json:"pre_release"`
+	}
+	if err := fetchJSON("https://www.python.org/api/v2/downloads/release/?is_published=true", &index); err != nil {
+		return nil, err
+	}
+	var releases []release
+	for _, r := range index {
+		version := strings.TrimPrefix(r.Name, "Python ")
+		releases = append(releases, release{
+			Version:    strings.ReplaceAll(version, " ", ""),
+			Prerelease: r.PreRelease,
+		})
+	}
+	return releases, nil
+}
+
+func fetchLuaReleases() ([]release, error) {
+	body, err := fetchBody("https://www.lua.org/ftp/")
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var releases []release
+	for _, m := range luaTarballPattern.FindAllStringSubmatch(string(body), -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			releases = append(releases, release{Version: m[1]})
+		}
+	}
+	return releases, nil
+}
+
+// fetchGitHubReleases lists the releases of a GitHub repository, stripping
+// tagPrefix from each tag name.
+func fetchGitHubReleases(repo, tagPrefix string) ([]release, error) {
+	var releases []release
+	for page := 1; page <= 3; page++ {
+		var batch []struct {
+			TagName    string `json:"tag_name"`
+			Prerelease bool   `json:"prerelease"`
+			Draft      bool   `json:"draft"`
+		}
+		url := fmt.Sprintf("https://api.github.com/repos/%s/releases?per_page=100&page=%d", repo, page)
+		if err := fetchJSON(url, &batch); err != nil {
+			return nil, err
+		}
+		for _, r := range batch {
+			version, ok := strings.CutPrefix(r.TagName, tagPrefix)
+			if !ok || r.Draft {
+				continue
+			}
+			releases = append(releases, release{
+				Version:    version,
+				Prerelease: r.Prerelease || prereleasePattern.MatchString(version),
+			})
+		}
+		if len(batch) < 100 {
+			break
+		}
+	}
+	return releases, nil
+}
+
+func fetchJSON(url string, v any) error {
+	body, err := fetchBody(url)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unexpected response from %s: %v", url, err)
+	}
+	return nil
+}
+
+func fetchBody(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "nix-envs/"+appVersion)
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" && strings.HasPrefix(url, "https://api.github.com/") {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("could not fetch %s (HTTP %d)", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
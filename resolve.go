@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var exactVersionPattern = regexp.MustCompile(`^\d+\.\d+\.\d+`)
+
+// resolveVersion turns a requested version of a template into the version to
+// build, as decided by the template.
+func resolveVersion(template, requested string) (string, error) {
+	t, err := lookupTemplate(template)
+	if err != nil {
+		return "", err
+	}
+	return t.Resolve(requested)
+}
+
+// resolveRelease resolves a requested version against the releases of t. It
+// accepts exact versions, partial versions ("20", "1.22"), "latest" and, when
+// lts is set, "lts" or "lts/<codename>". Exact versions are returned without a
+// network round-trip; fetching sources reports them if they don't exist
+// upstream.
+func resolveRelease(t Template, requested string, lts bool) (string, error) {
+	template := t.Name()
+	requested = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(requested)), "v")
+	if requested == "" {
+		return "", fmt.Errorf("no version given for %s", template)
+	}
+	if exactVersionPattern.MatchString(requested) {
+		return requested, nil
+	}
+
+	ltsName, isLTS := strings.CutPrefix(requested, "lts")
+	if isLTS {
+		if !lts {
+			return "", fmt.Errorf("%s has no LTS releases; use \"latest\" or a version", template)
+		}
+		ltsName = strings.TrimPrefix(ltsName, "/")
+		if ltsName == "*" {
+			ltsName = ""
+		}
+	}
+
+	releases, err := sortedReleases(t)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s %s: %v", template, requested, err)
+	}
+
+	system := hostSystem()
+	var fallback string
+	for _, r := range releases {
+		if !r.supports(system) {
+			continue
+		}
+		switch {
+		case isLTS:
+			if r.LTS != "" && (ltsName == "" || strings.EqualFold(r.LTS, ltsName)) {
+				return r.Version, nil
+			}
+		case requested == "latest":
+			if !r.Prerelease {
+				return r.Version, nil
+			}
+		case matchesPrefix(r.Version, requested):
+			if !r.Prerelease {
+				return r.Version, nil
+			}
+			if fallback == "" {
+				fallback = r.Version
+			}
+		}
+	}
+	if fallback != "" {
+		return fallback, nil
+	}
+	return "", fmt.Errorf("no %s release matches %q", template, requested)
+}
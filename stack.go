@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stackTemplate is the template recorded for stacked environments.
+const stackTemplate = "stack"
+
+// envComponent is one template of a stacked environment.
+type envComponent struct {
+	Template         string            `json:"template"`
+	RequestedVersion string            `json:"requested_version,omitempty"`
+	Version          string            `json:"version"`
+	Sources          map[string]source `json:"sources,omitempty"`
+}
+
+// parseStackArgs reads `<template> <version>` pairs as given to
+// `create --stack`.
+func parseStackArgs(args []string) ([]envComponent, error) {
+	if len(args) < 4 || len(args)%2 != 0 {
+		return nil, fmt.Errorf("A stack needs at least two <template> <version> pairs")
+	}
+	var components []envComponent
+	seen := make(map[string]bool)
+	for i := 0; i < len(args); i += 2 {
+		template := args[i]
+		if template == stackTemplate {
+			return nil, fmt.Errorf("Stacks cannot contain other stacks")
+		}
+		if seen[template] {
+			return nil, fmt.Errorf("Template %s appears more than once in the stack", template)
+		}
+		seen[template] = true
+		components = append(components, envComponent{Template: template, RequestedVersion: args[i+1]})
+	}
+	return components, nil
+}
+
+// stackSpecs resolves any component without a concrete version, fetches the
+// sources of components that have none and describes each component's shell.
+// Components are updated in place.
+func stackSpecs(components []envComponent) ([]*shellSpec, error) {
+	var specs []*shellSpec
+	for i := range components {
+		c := &components[i]
+		if c.Version == "" {
+			version, err := resolveVersion(c.Template, c.RequestedVersion)
+			if err != nil {
+				return nil, err
+			}
+			if version != c.RequestedVersion {
+				fmt.Printf("Resolved %s %s to %s\n", c.Template, c.RequestedVersion, version)
+			}
+			c.Version = version
+		}
+
+		if c.Sources == nil {
+			sources, err := fetchSources(c.Template, c.Version)
+			if err != nil {
+				return nil, err
+			}
+			c.Sources = sources
+		}
+		spec, err := buildSpec(c.Template, c.Version, c.Sources)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Flake != "" {
+			return nil, fmt.Errorf("%s provides a complete flake and cannot be stacked", c.Template)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// stackSummary describes a stack's components for display, e.g.
+// "nodejs 20.11.0 + go 1.22.3".
+func stackSummary(components []envComponent) string {
+	var parts []string
+	for _, c := range components {
+		parts = append(parts, c.Template+" "+c.Version)
+	}
+	return strings.Join(parts, " + ")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Template is a toolchain nix-envs can create environments for. Built-in
+// templates, user templates and plugins implement it alike.
+type Template interface {
+	Name() string
+	// Description is a one-line summary shown in help.
+	Description() string
+	// Releases lists the upstream versions, in any order.
+	Releases() ([]release, error)
+	// Resolve turns a requested version ("20", "latest", ...) into the
+	// version to build.
+	Resolve(requested string) (string, error)
+	// Fetch looks up the upstream artifacts of a version and their hashes,
+	// per system. Templates built from nixpkgs alone return nil.
+	Fetch(version string) (map[string]source, error)
+	// Render describes the devShell for a version built from sources, as
+	// returned by Fetch or read back from a lockfile.
+	Render(version string, sources map[string]source) (*shellSpec, error)
+}
+
+// builtinTemplate is a Template assembled from the functions of one of the
+// bundled toolchains.
+type builtinTemplate struct {
+	name        string
+	description string
+	// releases is nil for templates that are not versioned.
+	releases func() ([]release, error)
+	// lts is set for templates whose releases carry LTS codenames.
+	lts bool
+	// fixed lists versions that name a variant rather than a release, and
+	// are taken as given.
+	fixed  []string
+	fetch  func(version string) (map[string]source, error)
+	render func(version string, sources map[string]source) (*shellSpec, error)
+}
+
+func (t *builtinTemplate) Name() string        { return t.name }
+func (t *builtinTemplate) Description() string { return t.description }
+
+func (t *builtinTemplate) Releases() ([]release, error) {
+	if t.releases == nil {
+		return nil, fmt.Errorf("the %s template is not versioned", t.name)
+	}
+	return t.releases()
+}
+
+func (t *builtinTemplate) Resolve(requested string) (string, error) {
+	if t.releases == nil || contains(t.fixed, requested) {
+		return requested, nil
+	}
+	return resolveRelease(t, requested, t.lts)
+}
+
+func (t *builtinTemplate) Fetch(version string) (map[string]source, error) {
+	if t.fetch == nil {
+		return nil, nil
+	}
+	return t.fetch(version)
+}
+
+func (t *builtinTemplate) Render(version string, sources map[string]source) (*shellSpec, error) {
+	return t.render(version, sources)
+}
+
+var builtinTemplates = []*builtinTemplate{
+	{
+		name:        "nodejs",
+		description: "Node.js binaries from nodejs.org, with corepack",
+		releases:    fetchNodeReleases,
+		lts:         true,
+		fetch:       fetchNodeJS,
+		render:      generateNodeJS,
+	},
+	{
+		name:        "go",
+		description: "Go binaries from go.dev",
+		releases:    fetchGoReleases,
+		fetch:       fetchGo,
+		render:      generateGo,
+	},
+	{
+		name:        "rust",
+		description: "Rust stable toolchains from rust-overlay",
+		releases:    func() ([]release, error) { return fetchGitHubReleases("rust-lang/rust", "") },
+		render:      func(version string, _ map[string]source) (*shellSpec, error) { return generateRust(version), nil },
+	},
+	{
+		name:        "python",
+		description: "CPython built from python.org sources",
+		releases:    fetchPythonReleases,
+		fetch:       fetchPython,
+		render:      generatePython,
+	},
+	{
+		name:        "bun",
+		description: "Bun binaries from GitHub releases",
+		releases:    func() ([]release, error) { return fetchGitHubReleases("oven-sh/bun", "bun-v") },
+		fetch:       fetchBun,
+		render:      generateBun,
+	},
+	{
+		name:        "lua",
+		description: "Lua built from lua.org sources (version \"neovim\" for Neovim plugin work)",
+		releases:    fetchLuaReleases,
+		fixed:       []string{"neovim"},
+		fetch:       fetchLua,
+		render:      generateLua,
+	},
+	{
+		name:        "nix",
+		description: "Tools for working on Nix code",
+		render:      func(string, map[string]source) (*shellSpec, error) { return generateNix(), nil },
+	},
+	{
+		name:        "elixir",
+		description: "Elixir built from GitHub sources on Erlang/OTP 26",
+		releases:    func() ([]release, error) { return fetchGitHubReleases("elixir-lang/elixir", "v") },
+		fetch:       fetchElixir,
+		render:      generateElixir,
+	},
+}
+
+// lookupTemplate finds a template by name: built-in templates first, then
+// user templates, then plugins on PATH.
+func lookupTemplate(name string) (Template, error) {
+	for _, t := range builtinTemplates {
+		if t.name == name {
+			return t, nil
+		}
+	}
+	t, err := loadUserTemplate(name)
+	if err == nil {
+		return t, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if p, err := lookupPlugin(name); err == nil {
+		return p, nil
+	}
+	return nil, fmt.Errorf("Unknown template: %s", name)
+}
+
+// allTemplates lists every available template in lookup order. User
+// templates that fail to load are reported and skipped.
+func allTemplates() []Template {
+	var templates []Template
+	for _, t := range builtinTemplates {
+		templates = append(templates, t)
+	}
+	for _, name := range listUserTemplates() {
+		if contains(templateNames(templates), name) {
+			continue
+		}
+		t, err := loadUserTemplate(name)
+		if err != nil {
+			fmt.Printf("%sWarning: %v%s\n", ColorYellow, err, ColorReset)
+			continue
+		}
+		templates = append(templates, t)
+	}
+	for _, p := range listPlugins() {
+		if !contains(templateNames(templates), p.name) {
+			templates = append(templates, p)
+		}
+	}
+	return templates
+}
+
+func templateNames(templates []Template) []string {
+	var names []string
+	for _, t := range templates {
+		names = append(names, t.Name())
+	}
+	return names
+}
+
+// fetchSources downloads or looks up the hashes of the upstream artifacts a
+// template version builds from. Templates built from nixpkgs alone have none.
+func fetchSources(template, version string) (map[string]source, error) {
+	t, err := lookupTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	return t.Fetch(version)
+}
+
+// buildSpec describes the devShell for a template version built from sources
+// returned by fetchSources or read back from a lockfile.
+func buildSpec(template, version string, sources map[string]source) (*shellSpec, error) {
+	t, err := lookupTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := t.Render(version, sources)
+	if err != nil {
+		return nil, err
+	}
+	spec.Template = template
+	return spec, nil
+}
+
+func handleTemplate(args []string) {
+	if len(args) < 2 || args[0] != "show" {
+		fatal("Usage: nix-envs template show <name>")
+	}
+	name := args[1]
+
+	t, err := lookupTemplate(name)
+	if err != nil {
+		// The flake skeleton and partials are shown by file name.
+		if content, readErr := nixTemplateFS.ReadFile("templates/" + name + ".nix.tmpl"); readErr == nil {
+			fmt.Printf("# templates/%s.nix.tmpl\n%s", name, content)
+			return
+		}
+		fatal(err.Error())
+	}
+	fmt.Printf("# %s: %s\n", name, t.Description())
+	switch t := t.(type) {
+	case *builtinTemplate:
+		content, err := nixTemplateFS.ReadFile("templates/" + name + ".nix.tmpl")
+		if err != nil {
+			fmt.Println("# No derivation template: its packages come from nixpkgs and flake inputs.")
+			break
+		}
+		fmt.Printf("# templates/%s.nix.tmpl\n%s", name, content)
+	case *userTemplate:
+		dir := filepath.Join(userTemplatesDir(), name)
+		for _, file := range []string{"template.toml", "template.nix"} {
+			if content, err := os.ReadFile(filepath.Join(dir, file)); err == nil {
+				fmt.Printf("# %s\n%s", filepath.Join(dir, file), content)
+			}
+		}
+	case *pluginTemplate:
+		fmt.Printf("# Rendered by the plugin %s.\n", t.path)
+	}
+	fmt.Println("\n# Shared pieces: nix-envs template show flake, nix-envs template show partials")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tomlDoc holds a parsed TOML document as a map from table name ("" for the
+// root table) to that table's keys. Dotted keys and inline tables are
+// flattened into nested table names, so `node = { version = "20" }` under
+// [tools] is stored as table "tools.node", key "version".
+//
+// Only the subset of TOML used by the files nix-envs reads is supported:
+// strings, integers, floats, booleans, arrays, inline tables and comments.
+// Arrays of tables ([[name]]) are treated like plain tables.
+type tomlDoc map[string]map[string]any
+
+func (d tomlDoc) table(name string) map[string]any {
+	if d[name] == nil {
+		d[name] = map[string]any{}
+	}
+	return d[name]
+}
+
+// str returns the string value of key in table, or "" if it is absent or not
+// a string.
+func (d tomlDoc) str(table, key string) string {
+	s, _ := d[table][key].(string)
+	return s
+}
+
+type tomlParser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func parseTOML(src string) (tomlDoc, error) {
+	p := &tomlParser{src: src, line: 1}
+	doc := tomlDoc{}
+	current := ""
+	doc.table(current)
+
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return doc, nil
+		}
+
+		if p.peek() == '[' {
+			p.pos++
+			array := !p.eof() && p.peek() == '['
+			if array {
+				p.pos++
+			}
+			name, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(']'); err != nil {
+				return nil, err
+			}
+			if array {
+				if err := p.expect(']'); err != nil {
+					return nil, err
+				}
+			}
+			current = strings.Join(name, ".")
+			doc.table(current)
+		} else {
+			key, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect('='); err != nil {
+				return nil, err
+			}
+			table := strings.Join(append([]string{current}, key[:len(key)-1]...), ".")
+			table = strings.TrimPrefix(table, ".")
+			if err := p.parseAssignment(doc, table, key[len(key)-1]); err != nil {
+				return nil, err
+			}
+		}
+
+		p.skipSpaces()
+		if !p.eof() && p.peek() != '\n' && p.peek() != '#' && p.peek() != '\r' {
+			return nil, p.errorf("unexpected %q after value", p.peek())
+		}
+	}
+}
+
+// parseAssignment parses a value and stores it under table.key. Inline tables
+// become their own table.
+func (p *tomlParser) parseAssignment(doc tomlDoc, table, key string) error {
+	p.skipSpaces()
+	if !p.eof() && p.peek() == '{' {
+		p.pos++
+		name := strings.TrimPrefix(table+"."+key, ".")
+		doc.table(name)
+		for {
+			p.skipSpaces()
+			if p.eof() || p.peek() == '\n' {
+				return p.errorf("unterminated inline table")
+			}
+			if p.peek() == '}' {
+				p.pos++
+				return nil
+			}
+			inner, err := p.parseKey()
+			if err != nil {
+				return err
+			}
+			if err := p.expect('='); err != nil {
+				return err
+			}
+			sub := strings.Join(append([]string{name}, inner[:len(inner)-1]...), ".")
+			if err := p.parseAssignment(doc, sub, inner[len(inner)-1]); err != nil {
+				return err
+			}
+			p.skipSpaces()
+			if p.eof() {
+				return p.errorf("unterminated inline table")
+			}
+			if p.peek() == ',' {
+				p.pos++
+			}
+		}
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	doc.table(table)[key] = value
+	return nil
+}
+
+func (p *tomlParser) parseKey() ([]string, error) {
+	var parts []string
+	for {
+		p.skipSpaces()
+		var part string
+		switch {
+		case p.eof():
+			return nil, p.errorf("unexpected end of input in key")
+		case p.peek() == '"' || p.peek() == '\'':
+			s, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			part = s
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, p.errorf("invalid key")
+			}
+			part = p.src[start:p.pos]
+		}
+		parts = append(parts, part)
+		p.skipSpaces()
+		if p.eof() || p.peek() != '.' {
+			return parts, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *tomlParser) parseValue() (any, error) {
+	p.skipSpaces()
+	if p.eof() {
+		return nil, p.errorf("missing value")
+	}
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return p.parseString()
+	case c == '[':
+		p.pos++
+		var values []any
+		for {
+			p.skipBlank()
+			if p.eof() {
+				return nil, p.errorf("unterminated array")
+			}
+			if p.peek() == ']' {
+				p.pos++
+				return values, nil
+			}
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			p.skipBlank()
+			if p.eof() {
+				return nil, p.errorf("unterminated array")
+			}
+			if p.peek() == ',' {
+				p.pos++
+			} else if p.peek() != ']' {
+				return nil, p.errorf("expected ',' or ']' in array")
+			}
+		}
+	default:
+		start := p.pos
+		for !p.eof() && !strings.ContainsRune(",]}#\n\r", rune(p.peek())) {
+			p.pos++
+		}
+		raw := strings.TrimSpace(p.src[start:p.pos])
+		switch raw {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		clean := strings.ReplaceAll(raw, "_", "")
+		if n, err := strconv.ParseInt(clean, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(clean, 64); err == nil {
+			return f, nil
+		}
+		return nil, p.errorf("unsupported value %q", raw)
+	}
+}
+
+func (p *tomlParser) parseString() (string, error) {
+	quote := p.peek()
+	if strings.HasPrefix(p.src[p.pos:], strings.Repeat(string(quote), 3)) {
+		p.pos += 3
+		end := strings.Index(p.src[p.pos:], strings.Repeat(string(quote), 3))
+		if end < 0 {
+			return "", p.errorf("unterminated multi-line string")
+		}
+		s := strings.TrimPrefix(p.src[p.pos:p.pos+end], "\n")
+		p.line += strings.Count(p.src[p.pos:p.pos+end], "\n")
+		p.pos += end + 3
+		if quote == '"' {
+			return unescapeTOML(s), nil
+		}
+		return s, nil
+	}
+
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		if c == quote {
+			return b.String(), nil
+		}
+		if c == '\\' && quote == '"' && !p.eof() {
+			b.WriteString(unescapeTOML(`\` + string(p.peek())))
+			p.pos++
+			continue
+		}
+		b.WriteByte(c)
+	}
+}
+
+func unescapeTOML(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`, `\r`, "\r").Replace(s)
+}
+
+func (p *tomlParser) expect(c byte) error {
+	p.skipSpaces()
+	if p.eof() || p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *tomlParser) skipSpaces() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments.
+func (p *tomlParser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r':
+			p.pos++
+		case '\n':
+			p.line++
+			p.pos++
+		case '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) peek() byte { return p.src[p.pos] }
+func (p *tomlParser) eof() bool  { return p.pos >= len(p.src) }
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func isBareKeyChar(c byte) bool {
+	return c == '_' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	doc, err := parseTOML(`# nix-envs.toml
+top = "root"
+
+[envs.web]
+template = "nodejs"
+version = '20'
+stack = ["go", "1.22",
+  "rust", "1.77", # trailing comment
+]
+active = false
+count = 1_000
+ratio = 0.5
+
+[tools]
+node = { version = "20", opts.lts = true }
+"quoted key" = """
+multi
+line"""
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		table, key string
+		want       any
+	}{
+		{"", "top", "root"},
+		{"envs.web", "template", "nodejs"},
+		{"envs.web", "version", "20"},
+		{"envs.web", "stack", []any{"go", "1.22", "rust", "1.77"}},
+		{"envs.web", "active", false},
+		{"envs.web", "count", int64(1000)},
+		{"envs.web", "ratio", 0.5},
+		{"tools.node", "version", "20"},
+		{"tools.node.opts", "lts", true},
+		{"tools", "quoted key", "multi\nline"},
+	}
+	for _, c := range checks {
+		if got := doc[c.table][c.key]; !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s.%s = %#v, want %#v", c.table, c.key, got, c.want)
+		}
+	}
+}
+
+func TestParseTOMLMalformed(t *testing.T) {
+	cases := []struct {
+		src, err string
+	}{
+		{`x = [1, 2`, "unterminated array"},
+		{`x = [1, 2,`, "unterminated array"},
+		{"x = [\n", "unterminated array"},
+		{`x = { a = 1`, "unterminated inline table"},
+		{`x = { a = 1,`, "unterminated inline table"},
+		{"x = { a = 1\ny = 2 }", "unterminated inline table"},
+		{`x = `, "missing value"},
+		{`x = "abc`, "unterminated string"},
+		{`x = """abc`, "unterminated multi-line string"},
+		{`x = ["a" "b"]`, "expected ',' or ']' in array"},
+		{`x = nope`, `unsupported value "nope"`},
+		{`x`, `expected '='`},
+		{`[`, "unexpected end of input in key"},
+		{`[envs`, `expected ']'`},
+		{`[[envs]`, `expected ']'`},
+		{`x = "a" y = 2`, "unexpected 'y' after value"},
+	}
+	for _, c := range cases {
+		_, err := parseTOML(c.src)
+		if err == nil {
+			t.Errorf("parseTOML(%q) succeeded, want error containing %q", c.src, c.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("parseTOML(%q) = %v, want error containing %q", c.src, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// toolNames maps asdf and mise tool names to nix-envs templates.
+var toolNames = map[string]string{
+	"node":   "nodejs",
+	"nodejs": "nodejs",
+	"go":     "go",
+	"golang": "go",
+	"rust":   "rust",
+	"python": "python",
+	"bun":    "bun",
+	"lua":    "lua",
+	"elixir": "elixir",
+}
+
+// exportNames holds the tool name each format uses for a template.
+var exportNames = map[string]map[string]string{
+	"tool-versions": {
+		"nodejs": "nodejs", "go": "golang", "rust": "rust", "python": "python",
+		"bun": "bun", "lua": "lua", "elixir": "elixir",
+	},
+	"mise": {
+		"nodejs": "node", "go": "go", "rust": "rust", "python": "python",
+		"bun": "bun", "lua": "lua", "elixir": "elixir",
+	},
+}
+
+var elixirOTPSuffix = regexp.MustCompile(`-otp-\d+$`)
+
+func handleImport(args []string) {
+	_, flags := parseFlags(args)
+	yes := flags.has("--yes")
+	track := flags.has("--track")
+
+	var tools []detection
+	seen := make(map[string]bool)
+	add := func(found []detection) {
+		for _, t := range found {
+			if !seen[t.Template] {
+				seen[t.Template] = true
+				tools = append(tools, t)
+			}
+		}
+	}
+
+	if data, err := os.ReadFile(".tool-versions"); err == nil {
+		add(parseToolVersions(string(data)))
+	}
+	for _, file := range []string{"mise.toml", ".mise.toml"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		found, err := parseMiseTools(string(data), file)
+		if err != nil {
+			fatal(fmt.Sprintf("Failed to parse %s: %v", file, err))
+		}
+		add(found)
+	}
+
+	if len(tools) == 0 {
+		fatal("No supported tools found in .tool-versions or mise.toml.")
+	}
+
+	fmt.Println("Tools to import:")
+	for _, t := range tools {
+		fmt.Printf("  %-8s %-10s (from %s)\n", t.Template, t.Version, t.Source)
+	}
+
+	var failed []string
+	for _, t := range tools {
+		if !yes && !confirm(fmt.Sprintf("Create %s %s?", t.Template, t.Version)) {
+			continue
+		}
+		if err := createEnv(envRequest{Template: t.Template, Version: t.Version, Track: track}); err != nil {
+			fmt.Printf("%sError: %s%s\n", ColorRed, err.Error(), ColorReset)
+			failed = append(failed, t.Template)
+		}
+	}
+	if len(failed) > 0 {
+		fatal("Failed to import: " + strings.Join(failed, ", "))
+	}
+}
+
+func handleExport(args []string) {
+	_, flags := parseFlags(args, "--format")
+	format := flags.value("--format")
+	if format == "" {
+		format = "tool-versions"
+	}
+	names, ok := exportNames[format]
+	if !ok {
+		fatal("Usage: nix-envs export [--format tool-versions|mise]")
+	}
+
+	// With several instances of a template, including stack components, the
+	// one active in .envrc wins.
+	versions := make(map[string]string)
+	var order []string
+	for _, env := range loadProjectEnvs(getProject().ID) {
+		tools := env.Meta.Components
+		if len(tools) == 0 {
+			tools = []envComponent{{Template: env.Meta.Template, Version: env.Meta.Version}}
+		}
+		for _, tool := range tools {
+			name, ok := names[tool.Template]
+			if !ok || !exactVersionPattern.MatchString(tool.Version) {
+				continue
+			}
+			if _, dup := versions[name]; !dup {
+				order = append(order, name)
+			} else if !envrcReferences(".", env.Dir) {
+				continue
+			}
+			versions[name] = tool.Version
+		}
+	}
+	if len(order) == 0 {
+		fatal("No exportable environments found for this project.")
+	}
+
+	var path string
+	var err error
+	if format == "mise" {
+		path = "mise.toml"
+		err = writeMiseTools(path, order, versions)
+	} else {
+		path = ".tool-versions"
+		err = writeToolVersions(path, order, versions)
+	}
+	if err != nil {
+		fatal(fmt.Sprintf("Failed to write %s: %v", path, err))
+	}
+	fmt.Printf("%sExported %d tools to %s%s\n", ColorGreen, len(order), path, ColorReset)
+}
+
+// importVersion normalizes a version string from asdf or mise, returning ""
+// for versions nix-envs cannot build (system, ref:, path: and the like).
+func importVersion(template, version string) string {
+	version = strings.TrimPrefix(version, "prefix:")
+	if version == "" || version == "system" || strings.Contains(version, ":") {
+		return ""
+	}
+	if template == "elixir" {
+		version = elixirOTPSuffix.ReplaceAllString(version, "")
+	}
+	if template == "rust" && version == "stable" {
+		return "latest"
+	}
+	return version
+}
+
+func parseToolVersions(content string) []detection {
+	var found []detection
+	for _, line := range strings.Split(content, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		template, ok := toolNames[fields[0]]
+		if !ok {
+			continue
+		}
+		if version := importVersion(template, fields[1]); version != "" {
+			found = append(found, detection{template, version, ".tool-versions"})
+		}
+	}
+	return found
+}
+
+// parseMiseTools reads the [tools] table of a mise config. Values may be a
+// version string, a list of versions (the first wins) or an inline table with
+// a version key.
+func parseMiseTools(content, file string) ([]detection, error) {
+	doc, err := parseTOML(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []detection
+	add := func(tool string, value any) {
+		template, ok := toolNames[tool]
+		if !ok {
+			return
+		}
+		if list, ok := value.([]any); ok && len(list) > 0 {
+			value = list[0]
+		}
+		version, _ := value.(string)
+		if version = importVersion(template, version); version != "" {
+			found = append(found, detection{template, version, file})
+		}
+	}
+
+	for _, tool := range sortedKeys(doc["tools"]) {
+		add(tool, doc["tools"][tool])
+	}
+	for _, table := range sortedKeys(doc) {
+		if tool, ok := strings.CutPrefix(table, "tools."); ok {
+			add(tool, doc[table]["version"])
+		}
+	}
+	return found, nil
+}
+
+// writeToolVersions updates the lines for the given tools in a .tool-versions
+// file, keeping any other tools it lists.
+func writeToolVersions(path string, order []string, versions map[string]string) error {
+	content, _ := os.ReadFile(path)
+	written := make(map[string]bool)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			if v, ok := versions[fields[0]]; ok {
+				line = fields[0] + " " + v
+				written[fields[0]] = true
+			}
+		}
+		if line != "" || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	for _, name := range order {
+		if !written[name] {
+			lines = append(lines, name+" "+versions[name])
+		}
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// writeMiseTools updates entries in the [tools] table of a mise.toml, creating
+// the table or file when missing and leaving the rest of the file untouched.
+func writeMiseTools(path string, order []string, versions map[string]string) error {
+	content, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		lines = nil
+	}
+
+	start, end := -1, len(lines)
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if start < 0 && trimmed == "[tools]" {
+			start = i
+		} else if start >= 0 && strings.HasPrefix(trimmed, "[") {
+			end = i
+			break
+		}
+	}
+	if start < 0 {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "[tools]")
+		start, end = len(lines)-1, len(lines)
+	}
+
+	written := make(map[string]bool)
+	for i := start + 1; i < end; i++ {
+		key, _, ok := strings.Cut(lines[i], "=")
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		if v, known := versions[key]; ok && known {
+			lines[i] = fmt.Sprintf("%s = %q", key, v)
+			written[key] = true
+		}
+	}
+
+	// Insert new entries after the last non-blank line of the table.
+	insertAt := end
+	for insertAt > start+1 && strings.TrimSpace(lines[insertAt-1]) == "" {
+		insertAt--
+	}
+	var added []string
+	for _, name := range order {
+		if !written[name] {
+			added = append(added, fmt.Sprintf("%s = %q", name, versions[name]))
+		}
+	}
+	lines = append(lines[:insertAt], append(added, lines[insertAt:]...)...)
+
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
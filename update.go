@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+func handleUpdate(args []string) {
+	positional, flags := parseFlags(args)
+	if len(positional) < 1 {
+		fatal("Usage: nix-envs update <env> [version] [--yes]\n       nix-envs update <stack> [<template> <version>]... [--yes]")
+	}
+
+	name := positional[0]
+	cacheDir := getCacheDir(getProject().ID, name)
+	flakePath := filepath.Join(cacheDir, "flake.nix")
+
+	oldFlake, err := os.ReadFile(flakePath)
+	if err != nil {
+		fatal("Environment does not exist. Create it first.")
+	}
+
+	meta, err := readMetadata(cacheDir)
+	if err != nil {
+		meta = &envMetadata{
+			Template:    name,
+			Version:     flakeVersion(flakePath),
+			Arch:        hostSystem(),
+			ProjectRoot: getProjectRoot(),
+		}
+	}
+
+	if len(meta.Components) > 0 {
+		updateStack(name, cacheDir, string(oldFlake), meta, positional[1:], flags.has("--yes"))
+		return
+	}
+
+	requested := meta.RequestedVersion
+	version := ""
+	if len(positional) > 1 {
+		requested = positional[1]
+		version, err = resolveVersion(meta.Template, requested)
+		if err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		if meta.Version == "-" || meta.Version == "" {
+			fatal("Cannot determine the current version; pass one explicitly.")
+		}
+		fmt.Printf("Looking up the latest patch release of %s %s...\n", meta.Template, meta.Version)
+		version, err = latestPatch(meta.Template, meta.Version)
+		if err != nil {
+			fatal(err.Error())
+		}
+		if version == meta.Version {
+			fmt.Printf("%s%s is already at the latest patch release (%s).%s\n", ColorGreen, name, version, ColorReset)
+			return
+		}
+		if requested == "" || requested == meta.Version {
+			requested = version
+		}
+	}
+
+	fmt.Printf("%sUpdating %s environment from %s to %s...%s\n", ColorBlue, name, meta.Version, version, ColorReset)
+
+	next := *meta
+	next.Version = version
+	next.Sources = nil
+	flakeContent, err := renderEnv(&next)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if !applyFlake(cacheDir, string(oldFlake), flakeContent, flags.has("--yes")) {
+		return
+	}
+	lockFlake(cacheDir)
+
+	meta = &next
+	meta.RequestedVersion = requested
+	meta.Arch = hostSystem()
+	if err := writeMetadata(cacheDir, meta); err != nil {
+		fatal("Failed to write metadata.json: " + err.Error())
+	}
+	recordHistory(cacheDir)
+	if err := updateLock(name, meta); err != nil {
+		fatal(fmt.Sprintf("Failed to write %s: %v", lockFile, err))
+	}
+
+	fmt.Printf("%sUpdated %s to %s.%s\n", ColorGreen, name, version, ColorReset)
+}
+
+// updateStack updates the components of a stacked environment: the ones named
+// in pairs of `<template> <version>`, or with no pairs every component to the
+// latest patch release of its minor series.
+func updateStack(name, cacheDir, oldFlake string, meta *envMetadata, pairs []string, yes bool) {
+	if len(pairs)%2 != 0 {
+		fatal("Usage: nix-envs update <stack> [<template> <version>]... [--yes]")
+	}
+
+	components := slices.Clone(meta.Components)
+	changed := false
+	if len(pairs) > 0 {
+		for i := 0; i < len(pairs); i += 2 {
+			idx := slices.IndexFunc(components, func(c envComponent) bool { return c.Template == pairs[i] })
+			if idx < 0 {
+				fatal(fmt.Sprintf("Stack %s has no %s component.", name, pairs[i]))
+			}
+			version, err := resolveVersion(pairs[i], pairs[i+1])
+			if err != nil {
+				fatal(err.Error())
+			}
+			c := &components[idx]
+			if version != c.Version {
+				c.Sources = nil
+				changed = true
+			}
+			c.RequestedVersion, c.Version = pairs[i+1], version
+		}
+	} else {
+		for i := range components {
+			c := &components[i]
+			if !exactVersionPattern.MatchString(c.Version) {
+				continue
+			}
+			fmt.Printf("Looking up the latest patch release of %s %s...\n", c.Template, c.Version)
+			version, err := latestPatch(c.Template, c.Version)
+			if err != nil {
+				fatal(err.Error())
+			}
+			if version == c.Version {
+				continue
+			}
+			if c.RequestedVersion == "" || c.RequestedVersion == c.Version {
+				c.RequestedVersion = version
+			}
+			c.Version = version
+			c.Sources = nil
+			changed = true
+		}
+	}
+	if !changed {
+		fmt.Printf("%s%s is already up to date (%s).%s\n", ColorGreen, name, stackSummary(components), ColorReset)
+		return
+	}
+
+	fmt.Printf("%sUpdating %s stack from %s to %s...%s\n", ColorBlue, name, stackSummary(meta.Components), stackSummary(components), ColorReset)
+
+	next := *meta
+	next.Components = components
+	flakeContent, err := renderEnv(&next)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if !applyFlake(cacheDir, oldFlake, flakeContent, yes) {
+		return
+	}
+	lockFlake(cacheDir)
+
+	meta.Components = components
+	meta.Arch = hostSystem()
+	if err := writeMetadata(cacheDir, meta); err != nil {
+		fatal("Failed to write metadata.json: " + err.Error())
+	}
+	recordHistory(cacheDir)
+	if err := updateLock(name, meta); err != nil {
+		fatal(fmt.Sprintf("Failed to write %s: %v", lockFile, err))
+	}
+
+	fmt.Printf("%sUpdated %s to %s.%s\n", ColorGreen, name, stackSummary(components), ColorReset)
+}
+
+// applyFlake shows the diff between the current and regenerated flake.nix and
+// writes the new one once confirmed. It returns false if the user declined.
+func applyFlake(cacheDir, oldFlake, flakeContent string, yes bool) bool {
+	ops := diffLines(oldFlake, flakeContent)
+	if !hasChanges(ops) {
+		fmt.Println("flake.nix is unchanged.")
+		return true
+	}
+	printDiff(ops)
+	if !yes && !confirm("Apply these changes?") {
+		fmt.Println("Aborted.")
+		return false
+	}
+	recordHistory(cacheDir)
+	if err := os.WriteFile(filepath.Join(cacheDir, "flake.nix"), []byte(flakeContent), 0644); err != nil {
+		fatal("Failed to write flake.nix: " + err.Error())
+	}
+	return true
+}
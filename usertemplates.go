@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// userTemplate is a template defined in ~/.config/nix-envs/templates/<name>/
+// by a template.toml descriptor and an optional template.nix:
+//
+//	summary = "Zig from ziglang.org"   # shown in help
+//	description = "Zig {{.Version}} Environment"
+//	url = "https://ziglang.org/download/{{.Version}}/zig-{{.Arch}}-{{.Version}}.tar.xz"
+//	hash = "checksum"            # or "download" to hash the artifact itself
+//	checksum_url = "{{.URL}}.sha256"  # a SHASUMS-style listing or a bare digest
+//	packages = ["pkgs.zls"]
+//	versions_url = "https://ziglang.org/download/index.json"
+//	version_pattern = '"(\d+\.\d+\.\d+)"'
+//
+//	[arch]                       # {{.Arch}} per system; omit to fetch one URL everywhere
+//	x86_64-linux = "x86_64-linux"
+//	aarch64-darwin = "aarch64-macos"
+//
+// template.nix is the derivation built from the artifact, bound to
+// {{.Binding}} (e.g. zigCustom) and added to the shell's packages.
+type userTemplate struct {
+	name           string
+	Summary        string
+	FlakeDesc      string
+	URL            string
+	Hash           string
+	ChecksumURL    string
+	Arch           map[string]string
+	Packages       []string
+	Env            map[string]string
+	ShellHook      string
+	VersionsURL    string
+	VersionPattern *regexp.Regexp
+	Nix            string
+}
+
+// templateData is what descriptor strings and template.nix are rendered
+// with.
+type templateData struct {
+	Name    string
+	Version string
+	Arch    string
+	URL     string
+	Src     string
+	Binding string
+}
+
+func userTemplatesDir() string {
+	return filepath.Join(getConfigDir(), "templates")
+}
+
+// loadUserTemplate reads the user template called name. The error satisfies
+// os.IsNotExist when there is no such template.
+func loadUserTemplate(name string) (*userTemplate, error) {
+	dir := filepath.Join(userTemplatesDir(), name)
+	data, err := os.ReadFile(filepath.Join(dir, "template.toml"))
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseTOML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse template %s: %v", name, err)
+	}
+
+	t := &userTemplate{
+		name:        name,
+		Summary:     doc.str("", "summary"),
+		FlakeDesc:   doc.str("", "description"),
+		URL:         doc.str("", "url"),
+		Hash:        doc.str("", "hash"),
+		ChecksumURL: doc.str("", "checksum_url"),
+		ShellHook:   doc.str("", "shell_hook"),
+		VersionsURL: doc.str("", "versions_url"),
+		Arch:        map[string]string{},
+		Env:         map[string]string{},
+	}
+	if t.FlakeDesc == "" {
+		t.FlakeDesc = name + " {{.Version}} Environment"
+	}
+	if t.Summary == "" {
+		t.Summary = "Custom template from " + dir
+	}
+	if t.Hash == "" && t.URL != "" {
+		t.Hash = "download"
+		if t.ChecksumURL != "" {
+			t.Hash = "checksum"
+		}
+	}
+	if packages, ok := doc[""]["packages"].([]any); ok {
+		for _, p := range packages {
+			if s, ok := p.(string); ok {
+				t.Packages = append(t.Packages, s)
+			}
+		}
+	}
+	for system, arch := range doc["arch"] {
+		if !contains(flakeSystems, system) {
+			return nil, fmt.Errorf("template %s: unknown system %q in [arch]", name, system)
+		}
+		t.Arch[system], _ = arch.(string)
+	}
+	for key, value := range doc["env"] {
+		t.Env[key], _ = value.(string)
+	}
+	if pattern := doc.str("", "version_pattern"); pattern != "" {
+		if t.VersionPattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("template %s: invalid version_pattern: %v", name, err)
+		}
+	}
+
+	nix, err := os.ReadFile(filepath.Join(dir, "template.nix"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	t.Nix = strings.TrimSpace(string(nix))
+
+	switch {
+	case t.Nix != "" && t.URL == "":
+		return nil, fmt.Errorf("template %s: template.nix needs a url in template.toml", name)
+	case t.URL != "" && t.Hash != "checksum" && t.Hash != "download":
+		return nil, fmt.Errorf(`template %s: hash must be "checksum" or "download"`, name)
+	case t.Hash == "checksum" && t.ChecksumURL == "":
+		return nil, fmt.Errorf("template %s: hash = \"checksum\" needs a checksum_url", name)
+	}
+	return t, nil
+}
+
+// listUserTemplates returns the names of the user templates on disk.
+func listUserTemplates() []string {
+	dirs, err := os.ReadDir(userTemplatesDir())
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, d := range dirs {
+		if _, err := os.Stat(filepath.Join(userTemplatesDir(), d.Name(), "template.toml")); err == nil {
+			names = append(names, d.Name())
+		}
+	}
+	return names
+}
+
+// binding is the let-binding the template's derivation is bound to.
+func (t *userTemplate) binding() string {
+	return strings.TrimSuffix(stackShellName(t.name), "Shell") + "Custom"
+}
+
+func (t *userTemplate) expand(name, text string, data templateData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("template %s: %v", t.name, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("template %s: %v", t.name, err)
+	}
+	return b.String(), nil
+}
+
+func (t *userTemplate) Name() string        { return t.name }
+func (t *userTemplate) Description() string { return t.Summary }
+
+// Resolve resolves partial versions against versions_url. Without one,
+// versions are taken as given.
+func (t *userTemplate) Resolve(requested string) (string, error) {
+	if t.VersionsURL == "" {
+		return requested, nil
+	}
+	return resolveRelease(t, requested, false)
+}
+
+// Fetch hashes the template's artifact for every system it has an
+// arch for, or once for all systems when it has none.
+func (t *userTemplate) Fetch(version string) (map[string]source, error) {
+	if t.URL == "" {
+		return nil, nil
+	}
+	if len(t.Arch) == 0 {
+		src, err := t.fetchSource(version, "")
+		if err != nil {
+			return nil, err
+		}
+		return allSystems(src), nil
+	}
+
+	fmt.Printf("Fetching hashes for %s v%s...\n", t.name, version)
+	sources := make(map[string]source)
+	for _, system := range flakeSystems {
+		arch, ok := t.Arch[system]
+		if !ok {
+			continue
+		}
+		src, err := t.fetchSource(version, arch)
+		if err != nil {
+			if system == hostSystem() {
+				return nil, err
+			}
+			continue
+		}
+		sources[system] = src
+	}
+	if err := requireHostSource(sources, version); err != nil {
+		return nil, err
+	}
+	fmt.Printf("%sFound hashes for %s%s\n", ColorBlue, strings.Join(sourceSystems(sources), ", "), ColorReset)
+	return sources, nil
+}
+
+func (t *userTemplate) fetchSource(version, arch string) (source, error) {
+	data := templateData{Name: t.name, Version: version, Arch: arch}
+	url, err := t.expand("url", t.URL, data)
+	if err != nil {
+		return source{}, err
+	}
+	data.URL = url
+
+	if t.Hash == "download" {
+		fmt.Printf("Downloading %s to calculate its hash...\n", url)
+		body, err := fetchBody(url)
+		if err != nil {
+			return source{}, err
+		}
+		sum := sha256.Sum256(body)
+		return source{URL: url, SHA256: hex.EncodeToString(sum[:])}, nil
+	}
+
+	checksumURL, err := t.expand("checksum_url", t.ChecksumURL, data)
+	if err != nil {
+		return source{}, err
+	}
+	body, err := fetchBody(checksumURL)
+	if err != nil {
+		return source{}, err
+	}
+	// Either a SHASUMS-style listing or a file holding just the digest.
+	if hash, ok := parseShasums(string(body))[path.Base(url)]; ok {
+		return source{URL: url, SHA256: hash}, nil
+	}
+	if fields := strings.Fields(string(body)); len(fields) > 0 && len(fields[0]) == 64 {
+		return source{URL: url, SHA256: fields[0]}, nil
+	}
+	return source{}, fmt.Errorf("no hash for %s in %s", path.Base(url), checksumURL)
+}
+
+func (t *userTemplate) Render(version string, sources map[string]source) (*shellSpec, error) {
+	data := templateData{Name: t.name, Version: version, Binding: t.binding()}
+	description, err := t.expand("description", t.FlakeDesc, data)
+	if err != nil {
+		return nil, err
+	}
+	spec := &shellSpec{Description: description}
+
+	if t.Nix != "" {
+		if data.Src, err = nixFetchurl(sources); err != nil {
+			return nil, err
+		}
+		drv, err := t.expand("template.nix", t.Nix, data)
+		if err != nil {
+			return nil, err
+		}
+		drv = strings.TrimSuffix(strings.TrimSpace(drv), ";")
+		spec.Bindings = indentNix(data.Binding+" = "+drv+";", "      ")
+		spec.Packages = append(spec.Packages, data.Binding)
+	}
+	if len(t.Arch) > 0 {
+		spec.Systems = sourceSystems(sources)
+	}
+	spec.Packages = append(spec.Packages, t.Packages...)
+	for _, key := range sortedKeys(t.Env) {
+		value, err := t.expand("env", t.Env[key], data)
+		if err != nil {
+			return nil, err
+		}
+		spec.Env = append(spec.Env, envVar{key, nixString(value)})
+	}
+	if t.ShellHook != "" {
+		if spec.ShellHook, err = t.expand("shell_hook", t.ShellHook, data); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+// Releases lists the versions matched by version_pattern on versions_url.
+func (t *userTemplate) Releases() ([]release, error) {
+	if t.VersionsURL == "" || t.VersionPattern == nil {
+		return nil, fmt.Errorf("template %s does not set versions_url and version_pattern", t.name)
+	}
+	body, err := fetchBody(t.VersionsURL)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var releases []release
+	for _, m := range t.VersionPattern.FindAllStringSubmatch(string(body), -1) {
+		version := m[len(m)-1]
+		if !seen[version] {
+			seen[version] = true
+			releases = append(releases, release{
+				Version:    version,
+				Prerelease: strings.Contains(version, "-") || prereleasePattern.MatchString(version),
+			})
+		}
+	}
+	return releases, nil
+}
+
+// nixString quotes s as a Nix string, leaving ${...} interpolation intact.
+func nixString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
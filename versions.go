@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Elixir publishes security fixes for its last five minor series.
+const elixirSupportedSeries = 5
+
+func handleVersions(args []string) {
+	positional, flags := parseFlags(args)
+	if len(positional) < 1 {
+		fatal("Usage: nix-envs versions <template> [prefix] [--json]")
+	}
+	template := positional[0]
+	prefix := ""
+	if len(positional) > 1 {
+		prefix = strings.TrimPrefix(positional[1], "v")
+	}
+
+	releases, err := fetchReleases(template)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if err := annotateEOL(template, releases); err != nil {
+		fmt.Fprintf(os.Stderr, "%sWarning: could not determine end-of-life releases: %v%s\n", ColorYellow, err, ColorReset)
+	}
+
+	system := hostSystem()
+	filtered := []release{}
+	for _, r := range releases {
+		if r.supports(system) && (prefix == "" || matchesPrefix(r.Version, prefix)) {
+			filtered = append(filtered, r)
+		}
+	}
+
+	if flags.has("--json") {
+		out, _ := json.MarshalIndent(filtered, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	if len(filtered) == 0 {
+		fmt.Printf("No %s versions found for %s.\n", template, system)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tCHANNEL\tSTATUS")
+	for _, r := range filtered {
+		channel := "stable"
+		if r.Prerelease {
+			channel = "prerelease"
+		}
+		if r.LTS != "" {
+			channel = "lts (" + r.LTS + ")"
+		}
+		status := "supported"
+		if r.EOL {
+			status = "eol"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Version, channel, status)
+	}
+	w.Flush()
+}
+
+// annotateEOL marks releases whose series no longer receives upstream fixes.
+// Templates without a published support policy are left unmarked.
+func annotateEOL(template string, releases []release) error {
+	switch template {
+	case "nodejs":
+		return annotateNodeEOL(releases)
+	case "python":
+		return annotatePythonEOL(releases)
+	case "go":
+		// Each major Go release is supported until there are two newer ones.
+		markOldSeries(releases, 2)
+	case "elixir":
+		markOldSeries(releases, elixirSupportedSeries)
+	}
+	return nil
+}
+
+func annotateNodeEOL(releases []release) error {
+	var schedule map[string]struct {
+		End string `json:"end"`
+	}
+	if err := fetchJSON("https://raw.githubusercontent.com/nodejs/Release/main/schedule.json", &schedule); err != nil {
+		return err
+	}
+	today := time.Now().Format("2006-01-02")
+	for i, r := range releases {
+		major, _, _ := strings.Cut(r.Version, ".")
+		if entry, ok := schedule["v"+major]; ok && entry.End != "" && entry.End < today {
+			releases[i].EOL = true
+		}
+	}
+	return nil
+}
+
+func annotatePythonEOL(releases []release) error {
+	var cycle map[string]struct {
+		Status string `json:"status"`
+	}
+	if err := fetchJSON("https://raw.githubusercontent.com/python/devguide/main/include/release-cycle.json", &cycle); err != nil {
+		return err
+	}
+	for i, r := range releases {
+		if entry, ok := cycle[minorSeries(r.Version)]; ok && entry.Status == "end-of-life" {
+			releases[i].EOL = true
+		}
+	}
+	return nil
+}
+
+// markOldSeries flags every release outside the newest `supported` stable
+// major.minor series as end-of-life. releases must be sorted newest first.
+func markOldSeries(releases []release, supported int) {
+	var series []string
+	for _, r := range releases {
+		s := minorSeries(r.Version)
+		if !r.Prerelease && !contains(series, s) {
+			series = append(series, s)
+		}
+	}
+	if len(series) > supported {
+		series = series[:supported]
+	}
+	for i, r := range releases {
+		if !contains(series, minorSeries(r.Version)) {
+			releases[i].EOL = true
+		}
+	}
+}
+
+func minorSeries(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	_, suffix := splitNumeric(parts[1])
+	return parts[0] + "." + strings.TrimSuffix(parts[1], suffix)
+}